@@ -1,11 +1,17 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/bulkhead"
 	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/idempotency"
+	"RSOI_lab_3/pkg/leader"
 	"RSOI_lab_3/pkg/queue"
+	"RSOI_lab_3/pkg/retryworker"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,15 +27,36 @@ import (
 var (
 	ratingServiceURL, libraryServiceURL, reservationServiceURL string
 	httpClient                                                 *http.Client
-	libraryCB, ratingCB, reservationCB                         *circuitbreaker.CircuitBreaker
+	libraryBH, ratingBH, reservationBH                         *bulkhead.Bulkhead
 	retryQueue                                                 *queue.Queue
+	// breakers holds one circuit breaker per upstream endpoint.
+	breakers *circuitbreaker.Registry
+	// breakerStore is set when breaker state is shared between gateway
+	// replicas (CIRCUIT_BREAKER_STORE=redis).
+	breakerStore circuitbreaker.Store
+	// retryLeader elects the gateway replica whose in-process worker drains
+	// the shared retry queue.
+	retryLeader *leader.Elector
+	// gatewayClock drives the breakers, the retry queue and the retry worker.
+	gatewayClock clock.Clock = clock.Real()
 )
 
 const (
-	maxFailures = 3
-	timeout     = 30 * time.Second
-	retryDelay  = 10 * time.Second
-	maxRetries  = 5
+	maxFailures      = 3
+	timeout          = 30 * time.Second
+	halfOpenMaxCalls = 1
+	slowCallDuration = 5 * time.Second
+	slowCallRate     = 50
+	maxOpenTimeout   = 10 * time.Minute
+	openBackoff      = 2
+	openJitter       = 0.2
+	breakerSync      = 1 * time.Second
+	maxConcurrent    = 20
+	maxWaiting       = 50
+	maxBulkheadWait  = 2 * time.Second
+	redisCheck       = 10 * time.Second
+	enqueueTimeout   = 5 * time.Second
+	retryLeaderKey   = "retry_queue:leader"
 )
 
 func main() {
@@ -48,20 +75,35 @@ func main() {
 	})
 
 	ctx := context.Background()
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	retryQueue = openRetryQueue(ctx, redisClient, getEnv("RETRY_SPOOL_DIR", "retry-spool"))
+	if isLocalRetryQueue() {
+		go migrateRetryQueue(ctx, redisClient)
 	}
-	log.Printf("Connected to Redis at %s", redisAddr)
+	go flushRetrySpool(ctx)
 
 	httpClient = &http.Client{Timeout: 10 * time.Second}
-	libraryCB = circuitbreaker.NewCircuitBreaker(maxFailures, timeout)
-	ratingCB = circuitbreaker.NewCircuitBreaker(maxFailures, timeout)
-	reservationCB = circuitbreaker.NewCircuitBreaker(maxFailures, timeout)
-	retryQueue = queue.NewQueue(redisClient)
-
-	go processRetryQueue()
+	if getEnv("CIRCUIT_BREAKER_STORE", "local") == "redis" {
+		breakerStore = circuitbreaker.NewRedisStore(redisClient, "")
+		log.Println("Circuit breaker state is shared through Redis")
+	}
+	breakers = newBreakerRegistry()
+	libraryBH = newServiceBulkhead()
+	ratingBH = newServiceBulkhead()
+	reservationBH = newServiceBulkhead()
+
+	// With RETRY_WORKER=external retries are delivered by cmd/retryworker.
+	// Retries held in memory while Redis is down wait until they are moved.
+	if getEnv("RETRY_WORKER", "in-process") == "external" {
+		log.Println("In-process retry worker disabled, retries are left to the retry worker service")
+	} else {
+		retryLeader = leader.NewElector(redisClient, retryLeaderKey, gatewayID(), leader.WithClock(gatewayClock))
+		go retryLeader.Run(ctx)
+		go processRetryQueue(ctx)
+	}
 
 	r := gin.Default()
+	// Breaker names contain slashes, which admin requests send escaped.
+	r.UseRawPath = true
 	r.GET("/api/v1/libraries", getLibrariesHandler)
 	r.GET("/api/v1/libraries/:libraryUid/books", getLibraryBooksHandler)
 	r.GET("/api/v1/reservations", getReservationsHandler)
@@ -69,84 +111,332 @@ func main() {
 	r.POST("/api/v1/reservations/:reservationUid/return", returnBookHandler)
 	r.GET("/api/v1/rating", getRatingHandler)
 	r.GET("/manage/health", healthCheck)
+	r.GET("/manage/circuit-breakers", listCircuitBreakersHandler)
+	r.POST("/manage/circuit-breakers/:name/:action", circuitBreakerActionHandler)
+	r.GET("/manage/dead-letters", listDeadLettersHandler)
+	r.GET("/manage/dead-letters/:id", getDeadLetterHandler)
+	r.POST("/manage/dead-letters/:id/requeue", requeueDeadLetterHandler)
+	r.DELETE("/manage/dead-letters/:id", discardDeadLetterHandler)
+	r.GET("/manage/retry-queue", listRetryQueueHandler)
+	r.GET("/manage/retry-queue/stats", retryQueueStatsHandler)
+	r.GET("/manage/retry-queue/:id", getRetryRequestHandler)
+	r.DELETE("/manage/retry-queue/:id", deleteRetryRequestHandler)
+	r.POST("/manage/retry-queue/:id/run-now", runRetryRequestNowHandler)
 
 	log.Println("Gateway service starting on port 8080")
 	r.Run(":8080")
 }
 
-func processRetryQueue() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		for req := retryQueue.Dequeue(); req != nil; req = retryQueue.Dequeue() {
-			log.Printf("Retrying request %s (attempt %d/%d)", req.ID, req.RetryCount+1, req.MaxRetries)
-			if !executeRetryRequest(req) {
-				req.RetryCount++
-				if req.RetryCount < req.MaxRetries {
-					req.RetryAt = time.Now().Add(retryDelay)
-					if err := retryQueue.Enqueue(req); err != nil {
-						log.Printf("Failed to enqueue retry request %s: %v", req.ID, err)
-					}
-				}
-			}
-		}
+func newBreakerRegistry() *circuitbreaker.Registry {
+	opts := []circuitbreaker.Option{
+		circuitbreaker.WithClock(gatewayClock),
+		circuitbreaker.WithHalfOpenMaxCalls(halfOpenMaxCalls),
+		circuitbreaker.WithFailureClassifier(circuitbreaker.IsServerFailure),
+		circuitbreaker.WithSlowCalls(slowCallDuration, slowCallRate),
+		circuitbreaker.WithOpenBackoff(openBackoff, maxOpenTimeout, openJitter),
+	}
+	if breakerStore != nil {
+		opts = append(opts, circuitbreaker.WithStore(breakerStore, breakerSync))
 	}
+	registry := circuitbreaker.NewRegistry(circuitbreaker.Settings{
+		MaxFailures: maxFailures,
+		Timeout:     timeout,
+		Options:     opts,
+	})
+	registry.OnStateChange(func(change circuitbreaker.StateChange) {
+		log.Printf("Circuit breaker %s: %s -> %s (%s; calls=%d failures=%d slow=%d)",
+			change.Name, change.From, change.To, change.Reason,
+			change.Counts.Calls, change.Counts.Failures, change.Counts.SlowCalls)
+	})
+	// Created up front so they can be listed and forced open before the
+	// first call.
+	for _, endpoint := range endpoints {
+		registry.Get(endpoint)
+	}
+	return registry
+}
+
+// Upstream endpoints, named by service, method and route template. Each has
+// its own circuit breaker, so e.g. failing book lookups do not cut off the
+// library list.
+const (
+	librariesEndpoint          = "library GET /api/v1/libraries"
+	libraryEndpoint            = "library GET /api/v1/libraries/:libraryUid"
+	libraryBooksEndpoint       = "library GET /api/v1/libraries/:libraryUid/books"
+	bookEndpoint               = "library GET /api/v1/libraries/:libraryUid/books/:bookUid"
+	decreaseBookEndpoint       = "library POST /api/v1/libraries/:libraryUid/books/:bookUid/decrease"
+	increaseBookEndpoint       = "library POST /api/v1/libraries/:libraryUid/books/:bookUid/increase"
+	ratingEndpoint             = "rating GET /api/v1/rating"
+	adjustRatingEndpoint       = "rating POST /api/v1/rating/adjust"
+	reservationsEndpoint       = "reservation GET /api/v1/reservations"
+	activeReservationsEndpoint = "reservation GET /api/v1/reservations/active/count"
+	createReservationEndpoint  = "reservation POST /api/v1/reservations"
+	returnBookEndpoint         = "reservation POST /api/v1/reservations/:reservationUid/return"
+	rollbackEndpoint           = "reservation DELETE /api/v1/reservations/:reservationUid/rollback"
+)
+
+// endpoints lists the endpoints the gateway calls itself, whose breakers
+// newBreakerRegistry creates up front. Rollbacks are only sent by the retry
+// worker, so nothing would ever be recorded on a breaker of theirs.
+var endpoints = []string{
+	librariesEndpoint,
+	libraryEndpoint,
+	libraryBooksEndpoint,
+	bookEndpoint,
+	decreaseBookEndpoint,
+	increaseBookEndpoint,
+	ratingEndpoint,
+	adjustRatingEndpoint,
+	reservationsEndpoint,
+	activeReservationsEndpoint,
+	createReservationEndpoint,
+	returnBookEndpoint,
+}
+
+func newServiceBulkhead() *bulkhead.Bulkhead {
+	return bulkhead.NewBulkhead(maxConcurrent, maxWaiting, maxBulkheadWait)
 }
 
-func executeRetryRequest(req *queue.RetryRequest) bool {
-	httpReq, err := http.NewRequest(req.Method, req.URL, bytes.NewBuffer(req.Body))
+// callService runs fn behind the service's bulkhead and circuit breaker. A
+// call the breaker rejects fails at once without taking a bulkhead slot. A
+// call the bulkhead rejects never reaches the breaker and fails with
+// bulkhead.ErrBulkheadFull, which callers handle like an open breaker.
+func callService[T any](ctx context.Context, bh *bulkhead.Bulkhead, cb *circuitbreaker.CircuitBreaker, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if err := cb.Allow(); err != nil {
+		return zero, err
+	}
+	release, err := bh.Acquire(ctx)
 	if err != nil {
-		return false
+		return zero, err
+	}
+	defer release()
+	return circuitbreaker.Call(ctx, cb, fn, nil)
+}
+
+// isRetryPaused reports whether the breaker of the endpoint req targets is
+// open; the retry worker holds back such deliveries until it closes.
+func isRetryPaused(req *queue.RetryRequest) bool {
+	cb, ok := breakers.Lookup(req.Breaker)
+	return ok && cb.GetState() == circuitbreaker.StateOpen
+}
+
+// processRetryQueue runs the in-process retry worker until ctx is done.
+// With retryLeader set, only the elected replica drains the shared queue.
+func processRetryQueue(ctx context.Context) {
+	opts := []retryworker.Option{
+		retryworker.WithClock(gatewayClock),
+		retryworker.WithPause(isRetryPaused),
+	}
+	if retryLeader != nil {
+		opts = append(opts, retryworker.WithLeadership(retryLeadership{retryLeader}))
+	}
+	retryworker.New(retryQueue, httpClient, opts...).Run(ctx)
+}
+
+// retryLeadership requires the election only while the retry queue is in
+// Redis. Retries held in memory are seen by this replica alone, so it
+// always delivers them itself.
+type retryLeadership struct {
+	*leader.Elector
+}
+
+func (l retryLeadership) Token() (int64, bool) {
+	if isLocalRetryQueue() {
+		return 0, true
 	}
-	for k, v := range req.Headers {
-		httpReq.Header.Set(k, v)
+	return l.Elector.Token()
+}
+
+// Lock leaves the memory queue, drained under token zero, unfenced.
+func (l retryLeadership) Lock(token int64) (string, string) {
+	if token == 0 {
+		return "", ""
+	}
+	return l.Elector.Lock(token)
+}
+
+func isLocalRetryQueue() bool {
+	_, local := retryQueue.Backend().(*queue.MemoryBackend)
+	return local
+}
+
+// openRetryQueue keeps retries in Redis. Those Redis refuses, e.g. because
+// it is down at startup, are written to the spool in spoolDir and moved to
+// Redis by flushRetrySpool once it is back. Only if the spool cannot be
+// opened are retries held in memory while Redis is down; the caller then
+// runs migrateRetryQueue, and they are lost if the gateway stops before it
+// moves them.
+func openRetryQueue(ctx context.Context, redisClient *redis.Client, spoolDir string) *queue.Queue {
+	redisAddr := redisClient.Options().Addr
+	redisErr := redisClient.Ping(ctx).Err()
+	if redisErr == nil {
+		log.Printf("Connected to Redis at %s", redisAddr)
 	}
-	resp, err := httpClient.Do(httpReq)
+
+	spool, err := queue.OpenSpool(spoolDir)
 	if err != nil {
-		return false
+		log.Printf("Cannot open retry spool in %s, retries Redis refuses will be lost: %v", spoolDir, err)
+		if redisErr != nil {
+			// Keep serving; retries are held in memory until Redis is back.
+			log.Printf("Redis at %s is unavailable, queueing retries in memory: %v", redisAddr, redisErr)
+			return queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(gatewayClock))
+		}
+		return queue.NewQueueWithBackend(newRedisQueueBackend(redisClient), queue.WithClock(gatewayClock))
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
-}
-
-func executeWithCB(cb *circuitbreaker.CircuitBreaker, c *gin.Context, method, url string, body []byte, headers map[string]string, fallback func()) (*http.Response, error) {
-	var resp *http.Response
-	var fallbackCalled bool
-
-	err := cb.Execute(
-		func() error {
-			req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-			if err != nil {
-				return err
-			}
-			for k, v := range headers {
-				req.Header.Set(k, v)
-			}
-			resp, err = httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			if resp.StatusCode != http.StatusOK {
-				resp.Body.Close()
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			return nil
-		},
-		func() error {
-			fallbackCalled = true
-			fallback()
-			return nil
-		},
-	)
+	if redisErr != nil {
+		log.Printf("Redis at %s is unavailable, spooling retries to %s: %v", redisAddr, spoolDir, redisErr)
+	}
+	return queue.NewQueueWithBackend(newRedisQueueBackend(redisClient),
+		queue.WithClock(gatewayClock), queue.WithSpool(spool))
+}
 
-	if fallbackCalled {
-		return nil, nil
+// flushRetrySpool moves retries spooled while Redis was failing back to
+// the retry queue every redisCheck, once Redis takes them again.
+func flushRetrySpool(ctx context.Context) {
+	ticker := gatewayClock.NewTicker(redisCheck)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if retryQueue.Spooled() == 0 {
+			continue
+		}
+		moved, err := retryQueue.FlushSpool(ctx)
+		if moved > 0 {
+			log.Printf("Moved %d spooled retries to the retry queue", moved)
+		}
+		if err != nil && !failing {
+			log.Printf("Failed to move spooled retries, %d left: %v", retryQueue.Spooled(), err)
+		}
+		failing = err != nil
 	}
+}
+
+// gatewayID names this replica in Redis, e.g. as a stream consumer.
+func gatewayID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("gateway-%s-%d", host, os.Getpid())
+}
+
+// newRedisQueueBackend returns the configured Redis layout of the retry
+// queue: RETRY_QUEUE_BACKEND=streams delivers requests through a stream
+// consumer group, anything else uses sorted sets. Both share their keys, so
+// the setting can be changed between restarts.
+func newRedisQueueBackend(redisClient *redis.Client) queue.Backend {
+	if getEnv("RETRY_QUEUE_BACKEND", "sorted-set") == "streams" {
+		return queue.NewStreamBackend(redisClient, "", gatewayID())
+	}
+	return queue.NewRedisBackend(redisClient, "")
+}
+
+// migrateRetryQueue waits for Redis to become reachable, then moves the
+// retries queued in memory meanwhile to it and keeps using it.
+func migrateRetryQueue(ctx context.Context, redisClient *redis.Client) {
+	ticker := gatewayClock.NewTicker(redisCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			continue
+		}
+		if err := retryQueue.Migrate(ctx, newRedisQueueBackend(redisClient)); err != nil {
+			log.Printf("Failed to move queued retries to Redis: %v", err)
+			continue
+		}
+		log.Println("Redis is available again, retry queue moved to Redis")
+		return
+	}
+}
+
+// upstreamResponse is a fully read upstream reply, so nothing outlives the
+// circuit breaker call that produced it.
+type upstreamResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// executeWithCB returns the upstream reply, relaying 4xx replies too. It
+// returns nil once fallback has answered instead, or if the client went away,
+// in which case nothing is answered or queued on its behalf.
+func executeWithCB(ctx context.Context, bh *bulkhead.Bulkhead, cb *circuitbreaker.CircuitBreaker, method, url string, body []byte, headers map[string]string, fallback func()) *upstreamResponse {
+	resp, err := callService(ctx, bh, cb, func(ctx context.Context) (*upstreamResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &circuitbreaker.HTTPStatusError{StatusCode: resp.StatusCode, Body: respBody}
+		}
+		return &upstreamResponse{StatusCode: resp.StatusCode, Body: respBody}, nil
+	})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var statusErr *circuitbreaker.HTTPStatusError
+		if errors.As(err, &statusErr) && !circuitbreaker.IsServerFailure(err) {
+			return &upstreamResponse{StatusCode: statusErr.StatusCode, Body: statusErr.Body}
+		}
 		fallback()
-		return nil, nil
+		return nil
 	}
-	return resp, err
+	return resp
+}
+
+// relayClientError writes a non-5xx upstream error reply to the client as
+// is and reports whether it did so.
+func relayClientError(c *gin.Context, err error) bool {
+	var statusErr *circuitbreaker.HTTPStatusError
+	if errors.As(err, &statusErr) && !circuitbreaker.IsServerFailure(err) {
+		c.Data(statusErr.StatusCode, "application/json", statusErr.Body)
+		return true
+	}
+	return false
+}
+
+// fetchJSON performs a request and decodes a 2xx response into out.
+func fetchJSON(ctx context.Context, method, url string, headers map[string]string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return &circuitbreaker.HTTPStatusError{StatusCode: resp.StatusCode, Body: body}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
 }
 
 func getLibrariesHandler(c *gin.Context) {
@@ -155,7 +445,7 @@ func getLibrariesHandler(c *gin.Context) {
 	if params != "" {
 		url += "?" + params
 	}
-	resp, _ := executeWithCB(libraryCB, c, "GET", url, nil, nil, func() {
+	resp := executeWithCB(c.Request.Context(), libraryBH, breakers.Get(librariesEndpoint), "GET", url, nil, nil, func() {
 		libraryUid := "83575e12-7ce0-48ee-9931-51919ff3c9ee"
 		city := c.Query("city")
 		if city == "" {
@@ -178,9 +468,7 @@ func getLibrariesHandler(c *gin.Context) {
 	if resp == nil {
 		return
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	c.Data(resp.StatusCode, "application/json", body)
+	c.Data(resp.StatusCode, "application/json", resp.Body)
 }
 
 func getLibraryBooksHandler(c *gin.Context) {
@@ -190,7 +478,7 @@ func getLibraryBooksHandler(c *gin.Context) {
 	if queryparams != "" {
 		url += "?" + queryparams
 	}
-	resp, _ := executeWithCB(libraryCB, c, "GET", url, nil, nil, func() {
+	resp := executeWithCB(c.Request.Context(), libraryBH, breakers.Get(libraryBooksEndpoint), "GET", url, nil, nil, func() {
 		bookUid := "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
 		c.JSON(200, gin.H{
 			"page":          1,
@@ -210,9 +498,7 @@ func getLibraryBooksHandler(c *gin.Context) {
 	if resp == nil {
 		return
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	c.Data(resp.StatusCode, "application/json", body)
+	c.Data(resp.StatusCode, "application/json", resp.Body)
 }
 
 func getReservationsHandler(c *gin.Context) {
@@ -222,7 +508,7 @@ func getReservationsHandler(c *gin.Context) {
 		return
 	}
 	url := reservationServiceURL + "/api/v1/reservations"
-	resp, _ := executeWithCB(reservationCB, c, "GET", url, nil,
+	resp := executeWithCB(c.Request.Context(), reservationBH, breakers.Get(reservationsEndpoint), "GET", url, nil,
 		map[string]string{"X-User-Name": username}, func() {
 			c.JSON(200, []interface{}{})
 		})
@@ -230,16 +516,19 @@ func getReservationsHandler(c *gin.Context) {
 	if resp == nil {
 		return
 	}
-	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Data(resp.StatusCode, "application/json", resp.Body)
+		return
+	}
 
 	var reservations []map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&reservations)
+	json.Unmarshal(resp.Body, &reservations)
 	enrichedReservations := make([]map[string]interface{}, len(reservations))
 	for i, res := range reservations {
 		bookUid, _ := res["bookUid"].(string)
 		libraryUid, _ := res["libraryUid"].(string)
-		bookInfo := getBookInfoWithFallback(libraryUid, bookUid)
-		libraryInfo := getLibraryInfoWithFallback(libraryUid)
+		bookInfo, _ := getBookInfoWithFallback(c.Request.Context(), libraryUid, bookUid)
+		libraryInfo := getLibraryInfoWithFallback(c.Request.Context(), libraryUid)
 		enrichedReservations[i] = map[string]interface{}{
 			"reservationUid": res["reservationUid"],
 			"status":         res["status"],
@@ -276,8 +565,12 @@ func createReservationHandler(c *gin.Context) {
 		})
 		return
 	}
-	bookinfo := getBookInfoWithFallback(request.LibraryUid, request.BookUid)
-	if bookinfo == nil {
+	ctx := c.Request.Context()
+	bookinfo, err := getBookInfoWithFallback(ctx, request.LibraryUid, request.BookUid)
+	if err != nil {
+		if ctx.Err() != nil || relayClientError(c, err) {
+			return
+		}
 		requestWithCondition := map[string]interface{}{
 			"bookUid":       request.BookUid,
 			"libraryUid":    request.LibraryUid,
@@ -286,7 +579,7 @@ func createReservationHandler(c *gin.Context) {
 		}
 		body, _ := json.Marshal(requestWithCondition)
 		url := reservationServiceURL + "/api/v1/reservations"
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
+		queueRequestForRetry(createReservationEndpoint, "", deferredBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
 		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Bonus Service unavailable"})
 		return
 	}
@@ -296,8 +589,11 @@ func createReservationHandler(c *gin.Context) {
 		return
 	}
 
-	activeReservationsCount := getActiveReservationsCountWithFallback(username)
-	rating, ratingFallback := getUserRatingWithFallback(username)
+	activeReservationsCount := getActiveReservationsCountWithFallback(ctx, username)
+	rating, ratingFallback := getUserRatingWithFallback(ctx, username)
+	if ctx.Err() != nil {
+		return
+	}
 	if ratingFallback {
 		requestWithCondition := map[string]interface{}{
 			"bookUid":       request.BookUid,
@@ -307,7 +603,7 @@ func createReservationHandler(c *gin.Context) {
 		}
 		body, _ := json.Marshal(requestWithCondition)
 		url := reservationServiceURL + "/api/v1/reservations"
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
+		queueRequestForRetry(createReservationEndpoint, "", deferredBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
 		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Bonus Service unavailable"})
 		return
 	}
@@ -343,35 +639,45 @@ func createReservationHandler(c *gin.Context) {
 	url := reservationServiceURL + "/api/v1/reservations"
 	var reservation map[string]interface{}
 
-	resp, _ := executeWithCB(reservationCB, c, "POST", url, body,
+	resp := executeWithCB(ctx, reservationBH, breakers.Get(createReservationEndpoint), "POST", url, body,
 		map[string]string{"Content-Type": "application/json", "X-User-Name": username}, func() {
-			queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
+			queueRequestForRetry(createReservationEndpoint, "", deferredBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
 			c.JSON(200, gin.H{"message": "Reservation request queued for processing"})
 		})
 
 	if resp == nil {
 		return
 	}
-	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Data(resp.StatusCode, "application/json", resp.Body)
+		return
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&reservation)
+	err = json.Unmarshal(resp.Body, &reservation)
 	if err != nil {
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
+		queueRequestForRetry(createReservationEndpoint, "", deferredBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
 		c.JSON(200, gin.H{"message": "Reservation request queued for processing"})
 		return
 	}
-	err = decreaseBookCount(request.LibraryUid, request.BookUid)
+	err = decreaseBookCount(ctx, request.LibraryUid, request.BookUid)
 	if err != nil {
+		// The reservation is only created again once the rollback succeeded.
+		group := ""
 		if reservationUid, ok := reservation["reservationUid"].(string); ok {
-			queueRequestForRetry("DELETE", fmt.Sprintf("%s/api/v1/reservations/%s/rollback", reservationServiceURL, reservationUid), map[string]string{"X-User-Name": username}, nil)
+			group = reservationUid
+			queueRequestForRetry(rollbackEndpoint, group, compensationBackoff(), "DELETE", fmt.Sprintf("%s/api/v1/reservations/%s/rollback", reservationServiceURL, reservationUid), map[string]string{"X-User-Name": username}, nil)
+		}
+		if ctx.Err() != nil {
+			// Rolled back, but not created again for a client that left.
+			return
 		}
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
+		queueRequestForRetry(createReservationEndpoint, group, deferredBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, body)
 		c.JSON(200, gin.H{"message": "Reservation request queued for processing"})
 		return
 	}
 
-	libraryinfo := getLibraryInfoWithFallback(request.LibraryUid)
-	rating, _ = getUserRatingWithFallback(username)
+	libraryinfo := getLibraryInfoWithFallback(ctx, request.LibraryUid)
+	rating, _ = getUserRatingWithFallback(ctx, username)
 	response := map[string]interface{}{
 		"reservationUid": reservation["reservationUid"],
 		"status":         reservation["status"],
@@ -419,9 +725,13 @@ func returnBookHandler(c *gin.Context) {
 		return
 	}
 
-	reservation, err := getReservationInfoWithFallback(reservationUid, username)
+	ctx := c.Request.Context()
+	reservation, err := getReservationInfoWithFallback(ctx, reservationUid, username)
 	if err != nil {
-		if err.Error() == "service unavailable" {
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errServiceUnavailable) {
 			status := "RETURNED"
 			reqbody, _ := json.Marshal(map[string]interface{}{
 				"condition": request.Condition,
@@ -429,10 +739,13 @@ func returnBookHandler(c *gin.Context) {
 				"status":    status,
 			})
 			url := fmt.Sprintf("%s/api/v1/reservations/%s/return", reservationServiceURL, reservationUid)
-			queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, reqbody)
+			queueRequestForRetry(returnBookEndpoint, reservationUid, compensationBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, reqbody)
 			c.Status(204)
 			return
 		}
+		if relayClientError(c, err) {
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
 		return
 	}
@@ -465,34 +778,28 @@ func returnBookHandler(c *gin.Context) {
 	}
 
 	url := fmt.Sprintf("%s/api/v1/reservations/%s/return", reservationServiceURL, reservationUid)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqbody))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create the request"})
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-User-Name", username)
-	resp, err := httpClient.Do(req)
+	headers := map[string]string{"Content-Type": "application/json", "X-User-Name": username}
+	_, err = callService(ctx, reservationBH, breakers.Get(returnBookEndpoint), func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fetchJSON(ctx, "POST", url, headers, reqbody, nil)
+	})
 	if err != nil {
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, reqbody)
+		if ctx.Err() != nil || relayClientError(c, err) {
+			return
+		}
+		queueRequestForRetry(returnBookEndpoint, reservationUid, compensationBackoff(), "POST", url, headers, reqbody)
 		c.Status(204)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		body, _ := io.ReadAll(resp.Body)
-		c.Data(resp.StatusCode, "application/json", body)
-		return
-	}
 
 	libraryUid := reservation["libraryUid"].(string)
 	bookUid := reservation["bookUid"].(string)
-	err = increaseBookCount(libraryUid, bookUid)
+	increaseKey := uuid.New().String()
+	err = increaseBookCount(ctx, libraryUid, bookUid, increaseKey)
 	if err != nil {
-		queueRequestForRetry("POST", fmt.Sprintf("%s/api/v1/reservations/%s/rollback-return", reservationServiceURL, reservationUid), map[string]string{"Content-Type": "application/json", "X-User-Name": username}, nil)
-		queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json", "X-User-Name": username}, reqbody)
-		c.Status(204)
-		return
+		// The book is back, so only the count is retried. The same key
+		// keeps a retry after an ambiguous failure from counting it twice.
+		queueRequestForRetry(increaseBookEndpoint, reservationUid, compensationBackoff(), "POST", increaseBookURL(libraryUid, bookUid), map[string]string{idempotency.Header: increaseKey}, nil)
+		log.Printf("Failed to increase book count, queued for retry: %v", err)
 	}
 
 	bookConditionAtRental, ok := reservation["bookCondition"].(string)
@@ -517,14 +824,17 @@ func returnBookHandler(c *gin.Context) {
 	}
 
 	if ratingDelta != 0 {
-		err = adjustUserRating(username, ratingDelta)
-		if err != nil {
+		key := uuid.New().String()
+		err = adjustUserRating(ctx, username, ratingDelta, key)
+		if err != nil && !circuitbreaker.IsServerFailure(err) {
+			log.Printf("Rating service rejected adjustment: %v", err)
+		} else if err != nil {
 			url := ratingServiceURL + "/api/v1/rating/adjust"
 			body, _ := json.Marshal(map[string]interface{}{
 				"username": username,
 				"delta":    ratingDelta,
 			})
-			queueRequestForRetry("POST", url, map[string]string{"Content-Type": "application/json"}, body)
+			queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", url, map[string]string{"Content-Type": "application/json", idempotency.Header: key}, body)
 			log.Printf("Failed to update user rating, queued for retry: %v", err)
 		}
 	}
@@ -539,13 +849,8 @@ func getRatingHandler(c *gin.Context) {
 		return
 	}
 
-	if libraryCB.GetState() == circuitbreaker.StateOpen {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Bonus Service unavailable"})
-		return
-	}
-
 	url := ratingServiceURL + "/api/v1/rating"
-	resp, _ := executeWithCB(ratingCB, c, "GET", url, nil,
+	resp := executeWithCB(c.Request.Context(), ratingBH, breakers.Get(ratingEndpoint), "GET", url, nil,
 		map[string]string{"X-User-Name": username}, func() {
 			c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Bonus Service unavailable"})
 		})
@@ -553,9 +858,7 @@ func getRatingHandler(c *gin.Context) {
 	if resp == nil {
 		return
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	c.Data(resp.StatusCode, "application/json", body)
+	c.Data(resp.StatusCode, "application/json", resp.Body)
 }
 
 func healthCheck(c *gin.Context) {
@@ -573,191 +876,111 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func getBookInfoWithFallback(libraryUid, bookUid string) map[string]interface{} {
-	var result map[string]interface{}
-	var fallbackCalled bool
-	libraryCB.Execute(
-		func() error {
-			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/libraries/%s/books/%s", libraryServiceURL, libraryUid, bookUid), nil)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			return json.NewDecoder(resp.Body).Decode(&result)
-		},
-		func() error {
-			fallbackCalled = true
-			return nil
-		},
-	)
-	if fallbackCalled {
-		return nil
-	}
-	return result
+var (
+	errServiceUnavailable  = errors.New("service unavailable")
+	errReservationNotFound = errors.New("reservation not found")
+)
+
+// getBookInfoWithFallback returns the book or an error: an
+// *circuitbreaker.HTTPStatusError for 4xx replies, anything else when the
+// library service is unavailable.
+func getBookInfoWithFallback(ctx context.Context, libraryUid, bookUid string) (map[string]interface{}, error) {
+	url := fmt.Sprintf("%s/api/v1/libraries/%s/books/%s", libraryServiceURL, libraryUid, bookUid)
+	return callService(ctx, libraryBH, breakers.Get(bookEndpoint), func(ctx context.Context) (map[string]interface{}, error) {
+		var info map[string]interface{}
+		err := fetchJSON(ctx, "GET", url, nil, nil, &info)
+		return info, err
+	})
 }
 
-func getLibraryInfoWithFallback(libraryUid string) map[string]interface{} {
-	var result map[string]interface{}
-	libraryCB.Execute(
-		func() error {
-			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/libraries/%s", libraryServiceURL, libraryUid), nil)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			return json.NewDecoder(resp.Body).Decode(&result)
-		},
-		func() error {
-			result = map[string]interface{}{"libraryUid": libraryUid, "name": "", "address": "", "city": ""}
-			return nil
-		},
-	)
+func getLibraryInfoWithFallback(ctx context.Context, libraryUid string) map[string]interface{} {
+	url := fmt.Sprintf("%s/api/v1/libraries/%s", libraryServiceURL, libraryUid)
+	result, err := callService(ctx, libraryBH, breakers.Get(libraryEndpoint), func(ctx context.Context) (map[string]interface{}, error) {
+		var info map[string]interface{}
+		err := fetchJSON(ctx, "GET", url, nil, nil, &info)
+		return info, err
+	})
+	if err != nil {
+		return map[string]interface{}{"libraryUid": libraryUid, "name": "", "address": "", "city": ""}
+	}
 	return result
 }
 
-func getUserRatingWithFallback(username string) (map[string]interface{}, bool) {
-	var result map[string]interface{}
-	var fallbackCalled bool
-	err := ratingCB.Execute(
-		func() error {
-			req, _ := http.NewRequest("GET", ratingServiceURL+"/api/v1/rating", nil)
-			req.Header.Set("X-User-Name", username)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			return json.NewDecoder(resp.Body).Decode(&result)
-		},
-		func() error {
-			fallbackCalled = true
-			result = map[string]interface{}{"stars": 0}
-			return nil
-		},
-	)
+func getUserRatingWithFallback(ctx context.Context, username string) (map[string]interface{}, bool) {
+	result, err := callService(ctx, ratingBH, breakers.Get(ratingEndpoint), func(ctx context.Context) (map[string]interface{}, error) {
+		var rating map[string]interface{}
+		err := fetchJSON(ctx, "GET", ratingServiceURL+"/api/v1/rating", map[string]string{"X-User-Name": username}, nil, &rating)
+		return rating, err
+	})
 	if err != nil {
-		fallbackCalled = true
-		result = map[string]interface{}{"stars": 0}
-	}
-	return result, fallbackCalled
-}
-
-func getActiveReservationsCountWithFallback(username string) int {
-	var count int
-	reservationCB.Execute(
-		func() error {
-			req, _ := http.NewRequest("GET", reservationServiceURL+"/api/v1/reservations/active/count", nil)
-			req.Header.Set("X-User-Name", username)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			var result map[string]interface{}
-			json.NewDecoder(resp.Body).Decode(&result)
-			count = int(result["count"].(float64))
-			return nil
-		},
-		func() error {
-			count = 0
-			return nil
-		},
-	)
-	return count
+		return map[string]interface{}{"stars": 0}, true
+	}
+	return result, false
 }
 
-func getReservationInfoWithFallback(reservationUid, username string) (map[string]interface{}, error) {
-	var result map[string]interface{}
-	var err error
-	var fallbackCalled bool
-	reservationCB.Execute(
-		func() error {
-			req, _ := http.NewRequest("GET", reservationServiceURL+"/api/v1/reservations", nil)
-			req.Header.Set("X-User-Name", username)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("status %d", resp.StatusCode)
-			}
-			var reservations []map[string]interface{}
-			json.NewDecoder(resp.Body).Decode(&reservations)
-			for _, r := range reservations {
-				if r["reservationUid"] == reservationUid {
-					result = r
-					return nil
-				}
-			}
-			return fmt.Errorf("not found")
-		},
-		func() error {
-			fallbackCalled = true
-			return nil
-		},
-	)
-	if fallbackCalled {
-		return nil, fmt.Errorf("service unavailable")
-	}
-	return result, err
+func getActiveReservationsCountWithFallback(ctx context.Context, username string) int {
+	count, _ := callService(ctx, reservationBH, breakers.Get(activeReservationsEndpoint), func(ctx context.Context) (int, error) {
+		var result map[string]interface{}
+		err := fetchJSON(ctx, "GET", reservationServiceURL+"/api/v1/reservations/active/count", map[string]string{"X-User-Name": username}, nil, &result)
+		if err != nil {
+			return 0, err
+		}
+		count, _ := result["count"].(float64)
+		return int(count), nil
+	})
+	return count
 }
 
-func decreaseBookCount(libraryUid, bookUid string) error {
-	url := fmt.Sprintf("%s/api/v1/libraries/%s/books/%s/decrease", libraryServiceURL, libraryUid, bookUid)
-	req, err := http.NewRequest("POST", url, nil)
+func getReservationInfoWithFallback(ctx context.Context, reservationUid, username string) (map[string]interface{}, error) {
+	reservations, err := callService(ctx, reservationBH, breakers.Get(reservationsEndpoint), func(ctx context.Context) ([]map[string]interface{}, error) {
+		var reservations []map[string]interface{}
+		err := fetchJSON(ctx, "GET", reservationServiceURL+"/api/v1/reservations", map[string]string{"X-User-Name": username}, nil, &reservations)
+		return reservations, err
+	})
 	if err != nil {
-		return err
+		if ctx.Err() != nil || !circuitbreaker.IsServerFailure(err) {
+			return nil, err
+		}
+		return nil, errServiceUnavailable
 	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
+	for _, r := range reservations {
+		if r["reservationUid"] == reservationUid {
+			return r, nil
+		}
 	}
-	defer resp.Body.Close()
+	return nil, errReservationNotFound
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to decrease book count: status %d", resp.StatusCode)
+func decreaseBookCount(ctx context.Context, libraryUid, bookUid string) error {
+	url := fmt.Sprintf("%s/api/v1/libraries/%s/books/%s/decrease", libraryServiceURL, libraryUid, bookUid)
+	_, err := callService(ctx, libraryBH, breakers.Get(decreaseBookEndpoint), func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fetchJSON(ctx, "POST", url, nil, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decrease book count: %w", err)
 	}
-
 	return nil
 }
 
-func increaseBookCount(libraryUid, bookUid string) error {
-	url := fmt.Sprintf("%s/api/v1/libraries/%s/books/%s/increase", libraryServiceURL, libraryUid, bookUid)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return err
-	}
+func increaseBookURL(libraryUid, bookUid string) string {
+	return fmt.Sprintf("%s/api/v1/libraries/%s/books/%s/increase", libraryServiceURL, libraryUid, bookUid)
+}
 
-	resp, err := httpClient.Do(req)
+// increaseBookCount sends the increase under the given idempotency key, so
+// that a retry after an ambiguous failure is not applied twice.
+func increaseBookCount(ctx context.Context, libraryUid, bookUid, key string) error {
+	_, err := callService(ctx, libraryBH, breakers.Get(increaseBookEndpoint), func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fetchJSON(ctx, "POST", increaseBookURL(libraryUid, bookUid), map[string]string{idempotency.Header: key}, nil, nil)
+	})
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to increase book count: status %d", resp.StatusCode)
+		return fmt.Errorf("failed to increase book count: %w", err)
 	}
-
 	return nil
 }
 
-func adjustUserRating(username string, delta int) error {
+// adjustUserRating sends the adjustment under the given idempotency key, so
+// that a retry after an ambiguous failure is not applied twice.
+func adjustUserRating(ctx context.Context, username string, delta int, key string) error {
 	url := ratingServiceURL + "/api/v1/rating/adjust"
 	body, err := json.Marshal(map[string]interface{}{
 		"username": username,
@@ -767,35 +990,11 @@ func adjustUserRating(username string, delta int) error {
 		return err
 	}
 
-	var success bool
-	err = ratingCB.Execute(
-		func() error {
-			req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("failed to adjust rating: status %d", resp.StatusCode)
-			}
-
-			success = true
-			return nil
-		},
-		func() error {
-			return fmt.Errorf("rating service unavailable")
-		},
-	)
-
-	if err != nil || !success {
-		return fmt.Errorf("rating service unavailable")
+	_, err = callService(ctx, ratingBH, breakers.Get(adjustRatingEndpoint), func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fetchJSON(ctx, "POST", url, map[string]string{"Content-Type": "application/json", idempotency.Header: key}, body, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("rating service unavailable: %w", err)
 	}
 
 	return nil
@@ -817,17 +1016,59 @@ func isConditionWorse(originalCondition, returnedCondition string) bool {
 	return returnedOrder < originalOrder
 }
 
-func queueRequestForRetry(method, url string, headers map[string]string, body []byte) {
-	if err := retryQueue.Enqueue(&queue.RetryRequest{
-		ID:         uuid.New().String(),
-		Method:     method,
-		URL:        url,
-		Headers:    headers,
-		Body:       body,
-		RetryAt:    time.Now().Add(retryDelay),
-		RetryCount: 0,
-		MaxRetries: maxRetries,
-	}); err != nil {
+// compensationBackoff is used for requests that undo or complete work the
+// client has already been told about; they are retried for a day.
+func compensationBackoff() queue.BackoffPolicy {
+	return queue.BackoffPolicy{
+		Initial:    10 * time.Second,
+		Multiplier: 2,
+		Max:        10 * time.Minute,
+		Jitter:     0.2,
+		Deadline:   gatewayClock.Now().Add(24 * time.Hour),
+	}
+}
+
+// deferredBackoff is used for reservations accepted while a service was
+// down; after an hour the user has most likely moved on.
+func deferredBackoff() queue.BackoffPolicy {
+	return queue.BackoffPolicy{
+		Initial:    10 * time.Second,
+		Multiplier: 2,
+		Max:        2 * time.Minute,
+		Jitter:     0.2,
+		Deadline:   gatewayClock.Now().Add(time.Hour),
+	}
+}
+
+// queueRequestForRetry schedules a delivery to the upstream endpoint,
+// spacing the attempts by backoff; the retry worker holds it back while
+// that endpoint's breaker is open. Requests of the same group, e.g. a
+// reservation UID, are delivered one after another in the order they were
+// queued. Every attempt carries the same idempotency key: the one in
+// headers if the failed call already sent one, otherwise the request ID.
+// The request is queued even if the client that caused it has gone away.
+func queueRequestForRetry(endpoint, group string, backoff queue.BackoffPolicy, method, url string, headers map[string]string, body []byte) {
+	id := uuid.New().String()
+	withKey := map[string]string{idempotency.Header: id}
+	for k, v := range headers {
+		withKey[k] = v
+	}
+	req := &queue.RetryRequest{
+		ID:      id,
+		Method:  method,
+		URL:     url,
+		Headers: withKey,
+		Body:    body,
+		Breaker: endpoint,
+		Backoff: backoff,
+		Group:   group,
+	}
+	req.ScheduleRetry(gatewayClock.Now(), 0)
+	// A hanging Redis must not hold up the reply; with the spool the
+	// request is written to disk well before this runs out.
+	ctx, cancel := context.WithTimeout(context.Background(), enqueueTimeout)
+	defer cancel()
+	if err := retryQueue.Enqueue(ctx, req); err != nil {
 		log.Printf("Failed to queue request for retry: %v", err)
 	}
 }
@@ -1,11 +1,32 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/bulkhead"
+	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/idempotency"
+	"RSOI_lab_3/pkg/leader"
+	"RSOI_lab_3/pkg/queue"
+	"RSOI_lab_3/pkg/retryworker"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,6 +88,8 @@ func TestGetLibrariesHandler(t *testing.T) {
 
 	libraryServiceURL = "http://invalid-url"
 	httpClient = &http.Client{}
+	breakers = newBreakerRegistry()
+	libraryBH = newServiceBulkhead()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -74,7 +97,8 @@ func TestGetLibrariesHandler(t *testing.T) {
 
 	getLibrariesHandler(c)
 
-	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	// The library service is unreachable, so the fallback answers.
+	assert.Equal(t, http.StatusOK, w.Code)
 }
 
 func TestGetRatingHandler(t *testing.T) {
@@ -82,6 +106,8 @@ func TestGetRatingHandler(t *testing.T) {
 
 	ratingServiceURL = "http://invalid-url"
 	httpClient = &http.Client{}
+	breakers = newBreakerRegistry()
+	ratingBH = newServiceBulkhead()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -90,6 +116,936 @@ func TestGetRatingHandler(t *testing.T) {
 
 	getRatingHandler(c)
 
-	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
 }
 
+func TestExecuteWithCBRelaysClientErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Library not found"}`))
+	}))
+	defer upstream.Close()
+
+	httpClient = upstream.Client()
+	cb := newBreakerRegistry().Get(librariesEndpoint)
+
+	for i := 0; i < maxFailures+2; i++ {
+		fallbackCalled := false
+		resp := executeWithCB(context.Background(), newServiceBulkhead(), cb, "GET", upstream.URL, nil, nil, func() {
+			fallbackCalled = true
+		})
+		assert.False(t, fallbackCalled)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.JSONEq(t, `{"error":"Library not found"}`, string(resp.Body))
+	}
+	assert.Equal(t, circuitbreaker.StateClosed, cb.GetState())
+}
+
+func TestExecuteWithCBOpensOnServerErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	httpClient = upstream.Client()
+	cb := newBreakerRegistry().Get(librariesEndpoint)
+
+	for i := 0; i <= maxFailures; i++ {
+		fallbackCalled := false
+		resp := executeWithCB(context.Background(), newServiceBulkhead(), cb, "GET", upstream.URL, nil, nil, func() {
+			fallbackCalled = true
+		})
+		assert.True(t, fallbackCalled)
+		assert.Nil(t, resp)
+	}
+	assert.Equal(t, circuitbreaker.StateOpen, cb.GetState())
+}
+
+func TestOpenBreakerPausesRetries(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	httpClient = upstream.Client()
+	breakers = newBreakerRegistry()
+	cb := breakers.Get(adjustRatingEndpoint)
+
+	for i := 0; i <= maxFailures; i++ {
+		executeWithCB(context.Background(), newServiceBulkhead(), cb, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil, func() {})
+	}
+	assert.Equal(t, circuitbreaker.StateOpen, cb.GetState())
+	assert.True(t, isRetryPaused(&queue.RetryRequest{Breaker: adjustRatingEndpoint}))
+	assert.False(t, isRetryPaused(&queue.RetryRequest{Breaker: ratingEndpoint}))
+	assert.False(t, isRetryPaused(&queue.RetryRequest{Breaker: createReservationEndpoint}))
+}
+
+func TestFailingEndpointDoesNotOpenOtherRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/books/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer upstream.Close()
+
+	httpClient = upstream.Client()
+	libraryServiceURL = upstream.URL
+	libraryBH = newServiceBulkhead()
+	breakers = newBreakerRegistry()
+
+	for i := 0; i <= maxFailures; i++ {
+		_, err := getBookInfoWithFallback(context.Background(), "lib", "book")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, circuitbreaker.StateOpen, breakers.Get(bookEndpoint).GetState())
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/v1/libraries?city=Moscow", nil)
+	getLibrariesHandler(c)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"items":[]}`, w.Body.String())
+	assert.Equal(t, circuitbreaker.StateClosed, breakers.Get(librariesEndpoint).GetState())
+}
+
+func TestExecuteWithCBFallsBackWhenBulkheadFull(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	httpClient = upstream.Client()
+	cb := newBreakerRegistry().Get(librariesEndpoint)
+	bh := bulkhead.NewBulkhead(1, 0, time.Second)
+	release, _ := bh.Acquire(context.Background())
+	defer release()
+
+	fallbackCalled := false
+	resp := executeWithCB(context.Background(), bh, cb, "GET", upstream.URL, nil, nil, func() {
+		fallbackCalled = true
+	})
+	assert.True(t, fallbackCalled)
+	assert.Nil(t, resp)
+	assert.Equal(t, circuitbreaker.Counts{}, cb.Counts())
+}
+
+func TestCallServiceSkipsBulkheadWhileBreakerIsOpen(t *testing.T) {
+	cb := newBreakerRegistry().Get(librariesEndpoint)
+	cb.ForceOpen()
+	bh := bulkhead.NewBulkhead(1, 1, time.Minute)
+	release, _ := bh.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := callService(ctx, bh, cb, func(ctx context.Context) (struct{}, error) {
+		t.Error("rejected call ran")
+		return struct{}{}, nil
+	})
+	assert.ErrorIs(t, err, circuitbreaker.ErrOpenState)
+	assert.NoError(t, ctx.Err(), "rejected call waited for the bulkhead")
+}
+
+func TestCircuitBreakerAdminEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	breakers = newBreakerRegistry()
+	ratingCB, ok := breakers.Lookup(ratingEndpoint)
+	assert.True(t, ok, "breakers exist before the first call")
+	ratingPath := "/manage/circuit-breakers/" + url.PathEscape(ratingEndpoint)
+
+	r := gin.New()
+	r.UseRawPath = true
+	r.GET("/manage/circuit-breakers", listCircuitBreakersHandler)
+	r.POST("/manage/circuit-breakers/:name/:action", circuitBreakerActionHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", ratingPath+"/force-open", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, circuitbreaker.StateOpen, ratingCB.GetState())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/circuit-breakers", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var items []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &items)
+	assert.Len(t, items, len(endpoints))
+	for _, item := range items {
+		if item["name"] == ratingEndpoint {
+			assert.Equal(t, "open", item["state"])
+			assert.Equal(t, true, item["forced"])
+			assert.Nil(t, item["nextProbeTime"])
+		} else {
+			assert.Equal(t, "closed", item["state"])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", ratingPath+"/reset", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, circuitbreaker.StateClosed, ratingCB.GetState())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", ratingPath+"/explode", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/manage/circuit-breakers/unknown/reset", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func queueSize(t *testing.T) int {
+	n, err := retryQueue.Size(context.Background())
+	assert.NoError(t, err)
+	return n
+}
+
+func deadLetters(t *testing.T) []*queue.RetryRequest {
+	dead, err := retryQueue.GetDeadLetters(context.Background())
+	assert.NoError(t, err)
+	return dead
+}
+
+// startRetryWorker runs processRetryQueue against a fresh Redis and a fake
+// clock until the test ends.
+func startRetryWorker(t *testing.T, upstream *httptest.Server) *clock.Fake {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	httpClient = upstream.Client()
+	breakers = newBreakerRegistry()
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(fake))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processRetryQueue(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		gatewayClock = clock.Real()
+	})
+	return fake
+}
+
+func TestRetryWorkerReplaysDueRequests(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	start := fake.Now()
+	queueRequestForRetry(adjustRatingEndpoint, "", queue.BackoffPolicy{Initial: time.Minute}, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return hits.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, fake.Since(start), time.Minute)
+	assert.Equal(t, 0, queueSize(t))
+}
+
+func TestRetryWorkerRunsGroupInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.URL.Path)
+		if len(calls) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	reservation := upstream.URL + "/api/v1/reservations/r1"
+	queueRequestForRetry(rollbackEndpoint, "r1", compensationBackoff(), "DELETE", reservation+"/rollback", nil, nil)
+	queueRequestForRetry(returnBookEndpoint, "r1", compensationBackoff(), "POST", reservation+"/return", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls) == 3
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"/api/v1/reservations/r1/rollback",
+		"/api/v1/reservations/r1/rollback",
+		"/api/v1/reservations/r1/return",
+	}, calls)
+}
+
+func TestOnlyTheElectedGatewayDrainsRetryQueue(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	httpClient = upstream.Client()
+	breakers = newBreakerRegistry()
+	retryQueue = queue.NewQueue(client, queue.WithClock(fake))
+	ctx := context.Background()
+	other := leader.NewElector(client, retryLeaderKey, "gateway-other", leader.WithClock(fake))
+	leading, err := other.Campaign(ctx)
+	assert.NoError(t, err)
+	assert.True(t, leading)
+	retryLeader = leader.NewElector(client, retryLeaderKey, "gateway-self", leader.WithClock(fake))
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		processRetryQueue(workerCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		retryLeader = nil
+		gatewayClock = clock.Real()
+	}()
+
+	queueRequestForRetry(adjustRatingEndpoint, "", queue.BackoffPolicy{Initial: time.Second}, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+	for i := 0; i < 5; i++ {
+		retryLeader.Campaign(ctx)
+		fake.Advance(retryworker.Interval)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, int32(0), hits.Load(), "a follower leaves the queue to the leader")
+
+	assert.NoError(t, other.Resign(ctx))
+	leading, err = retryLeader.Campaign(ctx)
+	assert.NoError(t, err)
+	assert.True(t, leading)
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return hits.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRetriesInMemoryNeedNoElection(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	// Nobody can be elected while Redis is down.
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	mr.Close()
+	retryLeader = leader.NewElector(client, retryLeaderKey, "gateway-self")
+	t.Cleanup(func() { retryLeader = nil })
+
+	fake := startRetryWorker(t, upstream)
+	queueRequestForRetry(adjustRatingEndpoint, "", queue.BackoffPolicy{Initial: time.Second}, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return hits.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRetriesKeepIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(idempotency.Header))
+		if len(keys)%2 == 1 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	url := upstream.URL + "/api/v1/rating/adjust"
+	queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", url, map[string]string{idempotency.Header: "original"}, nil)
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		mu.Lock()
+		defer mu.Unlock()
+		return len(keys) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", url, nil, nil)
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		mu.Lock()
+		defer mu.Unlock()
+		return len(keys) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"original", "original"}, keys[:2])
+	assert.NotEmpty(t, keys[2])
+	assert.Equal(t, keys[2], keys[3])
+}
+
+func TestReturnRetriesBookCountUnderTheSameKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var increaseKey atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/reservations":
+			w.Write([]byte(`[{"reservationUid": "r1", "libraryUid": "l1", "bookUid": "b1", "bookCondition": "EXCELLENT", "tillDate": "2024-01-10"}]`))
+		case strings.HasSuffix(r.URL.Path, "/return"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/increase"):
+			increaseKey.Store(r.Header.Get(idempotency.Header))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer upstream.Close()
+
+	reservationServiceURL, libraryServiceURL, ratingServiceURL = upstream.URL, upstream.URL, upstream.URL
+	httpClient = upstream.Client()
+	breakers = newBreakerRegistry()
+	libraryBH, ratingBH, reservationBH = newServiceBulkhead(), newServiceBulkhead(), newServiceBulkhead()
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend())
+
+	r := gin.New()
+	r.POST("/api/v1/reservations/:reservationUid/return", returnBookHandler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/reservations/r1/return", strings.NewReader(`{"condition": "EXCELLENT", "date": "2024-01-05"}`))
+	req.Header.Set("X-User-Name", "Test Max")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	key, _ := increaseKey.Load().(string)
+	assert.NotEmpty(t, key)
+	queued, err := retryQueue.GetAll(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, queued, 1) {
+		assert.Equal(t, upstream.URL+"/api/v1/libraries/l1/books/b1/increase", queued[0].URL)
+		assert.Equal(t, key, queued[0].Headers[idempotency.Header])
+		assert.Equal(t, "r1", queued[0].Group)
+	}
+	assert.Equal(t, circuitbreaker.Counts{Calls: 1}, breakers.Get(returnBookEndpoint).Counts())
+	assert.Equal(t, circuitbreaker.Counts{Calls: 1, Failures: 1}, breakers.Get(increaseBookEndpoint).Counts())
+}
+
+func TestNothingIsQueuedForCancelledClients(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var cancel context.CancelFunc
+	var hangUpAt string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == hangUpAt {
+			// The upstream has the request when the client goes away.
+			io.Copy(io.Discard, r.Body)
+			cancel()
+			<-r.Context().Done()
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/libraries/l1/books/b1":
+			w.Write([]byte(`{"bookUid": "b1", "availableCount": 1, "condition": "EXCELLENT"}`))
+		case "/api/v1/reservations/active/count":
+			w.Write([]byte(`{"count": 0}`))
+		case "/api/v1/rating":
+			w.Write([]byte(`{"stars": 5}`))
+		}
+	}))
+	defer upstream.Close()
+
+	reservationServiceURL, libraryServiceURL, ratingServiceURL = upstream.URL, upstream.URL, upstream.URL
+	httpClient = upstream.Client()
+	breakers = newBreakerRegistry()
+	libraryBH, ratingBH, reservationBH = newServiceBulkhead(), newServiceBulkhead(), newServiceBulkhead()
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend())
+
+	r := gin.New()
+	r.POST("/api/v1/reservations", createReservationHandler)
+	r.POST("/api/v1/reservations/:reservationUid/return", returnBookHandler)
+	reserve := `{"bookUid": "b1", "libraryUid": "l1", "tillDate": "2024-01-10"}`
+	for _, tt := range []struct{ path, body, hangUpAt string }{
+		{"/api/v1/reservations", reserve, "/api/v1/libraries/l1/books/b1"},
+		{"/api/v1/reservations", reserve, "/api/v1/reservations"},
+		{"/api/v1/reservations/r1/return", `{"condition": "EXCELLENT", "date": "2024-01-05"}`, "/api/v1/reservations"},
+	} {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		hangUpAt = tt.hangUpAt
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)).WithContext(ctx)
+		req.Header.Set("X-User-Name", "Test Max")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		cancel()
+
+		assert.Equal(t, 0, queueSize(t), "%s hanging up at %s", tt.path, tt.hangUpAt)
+		for _, cb := range breakers.Breakers() {
+			assert.Equal(t, circuitbreaker.StateClosed, cb.GetState(), cb.Name())
+		}
+	}
+}
+
+func TestRetryWorkerKeepsFailedRequests(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return hits.Load() >= 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		all, err := retryQueue.GetAll(context.Background())
+		return err == nil && len(all) == 1 && all[0].RetryCount >= 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRetryWorkerDeadLettersExhaustedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	deadline := fake.Now().Add(time.Minute)
+	backoff := queue.BackoffPolicy{Initial: 10 * time.Second, Multiplier: 1, Deadline: deadline}
+	queueRequestForRetry(adjustRatingEndpoint, "", backoff, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return len(deadLetters(t)) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	dead := deadLetters(t)[0]
+	assert.Greater(t, dead.RetryCount, 1)
+	assert.False(t, fake.Now().Before(deadline.Add(-10*time.Second)), "given up before the deadline")
+	assert.Equal(t, http.StatusBadGateway, dead.LastStatus)
+	assert.Equal(t, "status 502", dead.LastError)
+	assert.Equal(t, 0, queueSize(t))
+}
+
+func TestDeadLetterEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend())
+	for _, id := range []string{"a", "b"} {
+		ctx := context.Background()
+		retryQueue.Enqueue(ctx, &queue.RetryRequest{ID: id, Method: "POST", URL: "http://rating.test/api/v1/rating/adjust", RetryAt: time.Now()})
+		req, _ := retryQueue.Claim(ctx, time.Minute)
+		req.LastStatus = http.StatusInternalServerError
+		req.LastError = "status 500"
+		retryQueue.DeadLetter(ctx, req)
+	}
+
+	r := gin.New()
+	r.GET("/manage/dead-letters", listDeadLettersHandler)
+	r.GET("/manage/dead-letters/:id", getDeadLetterHandler)
+	r.POST("/manage/dead-letters/:id/requeue", requeueDeadLetterHandler)
+	r.DELETE("/manage/dead-letters/:id", discardDeadLetterHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/dead-letters", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var items []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &items)
+	assert.Len(t, items, 2)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/dead-letters/a", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var item map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &item)
+	assert.Equal(t, "status 500", item["lastError"])
+	assert.Equal(t, float64(500), item["lastStatus"])
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/manage/dead-letters/a/requeue", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, queueSize(t))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/manage/dead-letters/b", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, deadLetters(t))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/dead-letters/b", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRetryQueueEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	defer func() { gatewayClock = clock.Real() }()
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(fake))
+	ctx := context.Background()
+	for i, target := range []string{"http://rating.test/a", "http://rating.test/b", "http://library.test/c"} {
+		retryQueue.Enqueue(ctx, &queue.RetryRequest{
+			ID:      strconv.Itoa(i),
+			Method:  "POST",
+			URL:     target,
+			RetryAt: fake.Now().Add(time.Duration(i+1) * time.Minute),
+		})
+		fake.Advance(10 * time.Second)
+	}
+
+	r := gin.New()
+	r.GET("/manage/retry-queue", listRetryQueueHandler)
+	r.GET("/manage/retry-queue/stats", retryQueueStatsHandler)
+	r.GET("/manage/retry-queue/:id", getRetryRequestHandler)
+	r.DELETE("/manage/retry-queue/:id", deleteRetryRequestHandler)
+	r.POST("/manage/retry-queue/:id/run-now", runRetryRequestNowHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue?page=2&size=2", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		TotalElements int                      `json:"totalElements"`
+		Items         []map[string]interface{} `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 3, page.TotalElements)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "2", page.Items[0]["id"])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue?size=100&page="+strconv.Itoa(math.MaxInt), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"depth": 3,
+		"due": 0,
+		"waiting": 0,
+		"oldestEnqueuedAt": "2024-01-01T12:00:00Z",
+		"oldestAgeSeconds": 30,
+		"hosts": {"rating.test": 2, "library.test": 1},
+		"spooled": 0
+	}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/manage/retry-queue/2/run-now", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	req, err := retryQueue.Peek(ctx)
+	if assert.NoError(t, err) && assert.NotNil(t, req) {
+		assert.Equal(t, "2", req.ID)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var item map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &item)
+	assert.Equal(t, "http://rating.test/b", item["url"])
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/manage/retry-queue/1", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 2, queueSize(t))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRetryQueueEndpointsShowWaitingRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	defer func() { gatewayClock = clock.Real() }()
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(fake))
+	ctx := context.Background()
+	for _, id := range []string{"return", "increase"} {
+		retryQueue.Enqueue(ctx, &queue.RetryRequest{ID: id, Group: "uid", Method: "POST", URL: "http://library.test/" + id, RetryAt: fake.Now()})
+	}
+
+	r := gin.New()
+	r.GET("/manage/retry-queue", listRetryQueueHandler)
+	r.GET("/manage/retry-queue/stats", retryQueueStatsHandler)
+	r.GET("/manage/retry-queue/:id", getRetryRequestHandler)
+	r.DELETE("/manage/retry-queue/:id", deleteRetryRequestHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue", nil))
+	var page struct {
+		TotalElements int                      `json:"totalElements"`
+		Items         []map[string]interface{} `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 2, page.TotalElements)
+	if assert.Len(t, page.Items, 2) {
+		assert.Equal(t, false, page.Items[0]["waiting"])
+		assert.Equal(t, "increase", page.Items[1]["id"])
+		assert.Equal(t, true, page.Items[1]["waiting"])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/stats", nil))
+	var stats struct {
+		Depth   int `json:"depth"`
+		Due     int `json:"due"`
+		Waiting int `json:"waiting"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 1, stats.Due)
+	assert.Equal(t, 1, stats.Waiting)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/increase", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/manage/retry-queue/increase", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, queueSize(t))
+}
+
+func TestRetryQueueStatsShowStreamConsumers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr := miniredis.RunT(t)
+	t.Setenv("RETRY_QUEUE_BACKEND", "streams")
+	backend := newRedisQueueBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	if !assert.IsType(t, &queue.StreamBackend{}, backend) {
+		return
+	}
+	retryQueue = queue.NewQueueWithBackend(backend)
+	ctx := context.Background()
+	retryQueue.Enqueue(ctx, &queue.RetryRequest{ID: "a", URL: "http://rating.test/api/v1/rating/adjust", RetryAt: time.Now()})
+	retryQueue.Enqueue(ctx, &queue.RetryRequest{ID: "b", URL: "http://rating.test/api/v1/rating/adjust", RetryAt: time.Now().Add(time.Hour)})
+	_, err := retryQueue.Claim(ctx, time.Minute)
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.GET("/manage/retry-queue/stats", retryQueueStatsHandler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/retry-queue/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats struct {
+		Depth             int            `json:"depth"`
+		ClaimedByConsumer map[string]int `json:"claimedByConsumer"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Equal(t, 1, stats.Depth)
+	assert.Len(t, stats.ClaimedByConsumer, 1)
+	for consumer, n := range stats.ClaimedByConsumer {
+		assert.True(t, strings.HasPrefix(consumer, "gateway-"), consumer)
+		assert.Equal(t, 1, n)
+	}
+}
+
+func TestRetryWorkerBacksOffWhileRedisIsDown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	mr := miniredis.RunT(t)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	defer func() { gatewayClock = clock.Real() }()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	var calls atomic.Int32
+	client.AddHook(countingHook{&calls})
+	retryQueue = queue.NewQueue(client, queue.WithClock(fake))
+	mr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processRetryQueue(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The pause doubles after every failure (5s, 10s, 20s, 40s), so of the
+	// twelve ticks during the first minute only those at 5s, 10s, 20s and
+	// 40s reach Redis.
+	for i := 0; i < 12; i++ {
+		fake.Advance(retryworker.Interval)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, calls.Load(), int32(4))
+	assert.Greater(t, calls.Load(), int32(0))
+}
+
+func TestRetryQueueMovesToRedisOnceReachable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	defer func() { gatewayClock = clock.Real() }()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	mr.Close()
+
+	retryQueue = queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(fake))
+	queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", "http://rating.test/api/v1/rating/adjust", nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		migrateRetryQueue(ctx, client)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		fake.Advance(redisCheck)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.IsType(t, &queue.MemoryBackend{}, retryQueue.Backend(), "Redis is still down")
+
+	assert.NoError(t, mr.Restart())
+	assert.Eventually(t, func() bool {
+		fake.Advance(redisCheck)
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	assert.IsType(t, &queue.RedisBackend{}, retryQueue.Backend())
+	assert.Equal(t, 1, queueSize(t))
+	members, err := mr.ZMembers("retry_queue")
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+}
+
+func TestRetriesAreSpooledWhileRedisRefusesThem(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	gatewayClock = fake
+	defer func() { gatewayClock = clock.Real() }()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	spool, err := queue.OpenSpool(t.TempDir())
+	assert.NoError(t, err)
+	retryQueue = queue.NewQueue(client, queue.WithClock(fake), queue.WithSpool(spool))
+
+	// Redis goes away after the gateway started on it.
+	mr.Close()
+	queueRequestForRetry(rollbackEndpoint, "r1", compensationBackoff(), "DELETE", "http://reservation.test/api/v1/reservations/r1/rollback", nil, nil)
+	queueRequestForRetry(adjustRatingEndpoint, "", compensationBackoff(), "POST", "http://rating.test/api/v1/rating/adjust", nil, nil)
+	assert.Equal(t, 2, retryQueue.Spooled())
+
+	done := make(chan struct{})
+	go func() {
+		flushRetrySpool(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	fake.Advance(redisCheck)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 2, retryQueue.Spooled(), "Redis is still down")
+
+	assert.NoError(t, mr.Restart())
+	assert.Eventually(t, func() bool {
+		fake.Advance(redisCheck)
+		return retryQueue.Spooled() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, queueSize(t))
+}
+
+func TestRetriesAreSpooledWhileRedisIsDownAtStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	mr.Close()
+	dir := t.TempDir()
+
+	retryQueue = openRetryQueue(ctx, client, dir)
+	assert.IsType(t, &queue.RedisBackend{}, retryQueue.Backend())
+	queueRequestForRetry(rollbackEndpoint, "r1", compensationBackoff(), "DELETE", "http://reservation.test/api/v1/reservations/r1/rollback", nil, nil)
+	assert.Equal(t, 1, retryQueue.Spooled())
+
+	// The spooled compensation survives a restart of the gateway.
+	retryQueue = openRetryQueue(ctx, client, dir)
+	assert.Equal(t, 1, retryQueue.Spooled())
+
+	assert.NoError(t, mr.Restart())
+	moved, err := retryQueue.FlushSpool(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	assert.Equal(t, 1, queueSize(t))
+}
+
+func TestRetryQueueFallsBackToMemoryWithoutSpool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	mr.Close()
+	notADir := filepath.Join(t.TempDir(), "spool")
+	assert.NoError(t, os.WriteFile(notADir, nil, 0o600))
+
+	retryQueue = openRetryQueue(ctx, client, notADir)
+	assert.IsType(t, &queue.MemoryBackend{}, retryQueue.Backend())
+}
+
+// countingHook counts the commands and scripts sent to Redis.
+type countingHook struct {
+	calls *atomic.Int32
+}
+
+func (h countingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h countingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.calls.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h countingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRetryWorkerHonoursRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	fake := startRetryWorker(t, upstream)
+	queueRequestForRetry(adjustRatingEndpoint, "", queue.BackoffPolicy{Initial: 10 * time.Second}, "POST", upstream.URL+"/api/v1/rating/adjust", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		fake.Advance(retryworker.Interval)
+		return hits.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		all, err := retryQueue.GetAll(context.Background())
+		return err == nil && len(all) == 1 && all[0].RetryAt.After(fake.Now().Add(100*time.Second))
+	}, time.Second, 10*time.Millisecond)
+}
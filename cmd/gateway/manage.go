@@ -0,0 +1,255 @@
+package main
+
+import (
+	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/queue"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func circuitBreakerJSON(snapshot circuitbreaker.Snapshot) gin.H {
+	return gin.H{
+		"name":            snapshot.Name,
+		"state":           snapshot.State.String(),
+		"forced":          snapshot.Forced,
+		"calls":           snapshot.Counts.Calls,
+		"failures":        snapshot.Counts.Failures,
+		"slowCalls":       snapshot.Counts.SlowCalls,
+		"lastFailureTime": optionalTime(snapshot.LastFailureTime),
+		"nextProbeTime":   optionalTime(snapshot.NextProbeTime),
+	}
+}
+
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func listCircuitBreakersHandler(c *gin.Context) {
+	all := breakers.Breakers()
+	items := make([]gin.H, 0, len(all))
+	for _, cb := range all {
+		items = append(items, circuitBreakerJSON(cb.Snapshot()))
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+func circuitBreakerActionHandler(c *gin.Context) {
+	cb, ok := breakers.Lookup(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "circuit breaker not found"})
+		return
+	}
+
+	switch c.Param("action") {
+	case "force-open":
+		cb.ForceOpen()
+	case "force-close":
+		cb.ForceClose()
+	case "reset":
+		cb.Reset()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be force-open, force-close or reset"})
+		return
+	}
+	c.JSON(http.StatusOK, circuitBreakerJSON(cb.Snapshot()))
+}
+
+func retryRequestJSON(req *queue.RetryRequest) gin.H {
+	return gin.H{
+		"id":         req.ID,
+		"endpoint":   req.Breaker,
+		"group":      req.Group,
+		"waiting":    req.Waiting(),
+		"method":     req.Method,
+		"url":        req.URL,
+		"headers":    req.Headers,
+		"body":       string(req.Body),
+		"enqueuedAt": optionalTime(req.EnqueuedAt),
+		"retryAt":    optionalTime(req.RetryAt),
+		"retryCount": req.RetryCount,
+		"maxRetries": req.MaxRetries,
+		"deadline":   optionalTime(req.Backoff.Deadline),
+		"lastError":  req.LastError,
+		"lastStatus": req.LastStatus,
+	}
+}
+
+// relayQueueError answers a failed retry queue operation.
+func relayQueueError(c *gin.Context, err error) {
+	if errors.Is(err, queue.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "retry request not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func listDeadLettersHandler(c *gin.Context) {
+	dead, err := retryQueue.GetDeadLetters(c.Request.Context())
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	items := make([]gin.H, 0, len(dead))
+	for _, req := range dead {
+		items = append(items, retryRequestJSON(req))
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+func getDeadLetterHandler(c *gin.Context) {
+	req, err := retryQueue.GetDeadLetter(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, retryRequestJSON(req))
+}
+
+func requeueDeadLetterHandler(c *gin.Context) {
+	if err := retryQueue.Requeue(c.Request.Context(), c.Param("id"), gatewayClock.Now()); err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func discardDeadLetterHandler(c *gin.Context) {
+	if err := retryQueue.Discard(c.Request.Context(), c.Param("id")); err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func listRetryQueueHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "20"))
+	if err != nil || size < 1 || size > 100 {
+		size = 20
+	}
+	if page-1 > math.MaxInt/size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page is out of range"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	total, err := retryQueue.Size(ctx)
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	pending, err := retryQueue.List(ctx, (page-1)*size, size)
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	items := make([]gin.H, 0, len(pending))
+	for _, req := range pending {
+		items = append(items, retryRequestJSON(req))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"page":          page,
+		"pageSize":      size,
+		"totalElements": total,
+		"items":         items,
+	})
+}
+
+// retryQueueStatsHandler reports the queue depth, how many requests are due,
+// how many wait for an earlier request of their group, the age of the
+// oldest request and how many requests target each host.
+func retryQueueStatsHandler(c *gin.Context) {
+	pending, err := retryQueue.GetAll(c.Request.Context())
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+
+	now := gatewayClock.Now()
+	due, waiting := 0, 0
+	var oldest time.Time
+	hosts := make(map[string]int)
+	for _, req := range pending {
+		if req.Waiting() {
+			waiting++
+		} else if !req.RetryAt.After(now) {
+			due++
+		}
+		if !req.EnqueuedAt.IsZero() && (oldest.IsZero() || req.EnqueuedAt.Before(oldest)) {
+			oldest = req.EnqueuedAt
+		}
+		host := ""
+		if u, err := url.Parse(req.URL); err == nil {
+			host = u.Host
+		}
+		hosts[host]++
+	}
+
+	var oldestAge interface{}
+	if !oldest.IsZero() {
+		oldestAge = int64(now.Sub(oldest).Seconds())
+	}
+	stats := gin.H{
+		"depth":            len(pending),
+		"due":              due,
+		"waiting":          waiting,
+		"oldestEnqueuedAt": optionalTime(oldest),
+		"oldestAgeSeconds": oldestAge,
+		"hosts":            hosts,
+		"spooled":          retryQueue.Spooled(),
+	}
+	// A stream backend also knows which consumer holds each claimed request.
+	if stream, ok := retryQueue.Backend().(*queue.StreamBackend); ok {
+		entries, err := stream.Pending(c.Request.Context())
+		if err != nil {
+			relayQueueError(c, err)
+			return
+		}
+		claimed := make(map[string]int)
+		for _, entry := range entries {
+			claimed[entry.Consumer]++
+		}
+		stats["claimedByConsumer"] = claimed
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func getRetryRequestHandler(c *gin.Context) {
+	req, err := retryQueue.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, retryRequestJSON(req))
+}
+
+func deleteRetryRequestHandler(c *gin.Context) {
+	if err := retryQueue.Remove(c.Request.Context(), c.Param("id")); err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// runRetryRequestNowHandler makes a scheduled request due immediately; the
+// retry worker picks it up on its next tick, or once the earlier requests
+// of its group are done if it is waiting for them.
+func runRetryRequestNowHandler(c *gin.Context) {
+	if err := retryQueue.Reschedule(c.Request.Context(), c.Param("id"), gatewayClock.Now()); err != nil {
+		relayQueueError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
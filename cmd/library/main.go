@@ -1,7 +1,11 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/idempotency"
 	"RSOI_lab_3/pkg/models"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -48,7 +52,7 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	err = db.AutoMigrate(&models.Library{}, &models.Book{}, &models.LibraryBook{})
+	err = db.AutoMigrate(&models.Library{}, &models.Book{}, &models.LibraryBook{}, &models.IdempotencyKey{})
 	if err != nil {
 		log.Fatalf("Database migration failed: %v", err)
 	}
@@ -67,6 +71,7 @@ func main() {
 	log.Println("Database ping successful")
 
 	seedTestData()
+	go idempotency.RunPruner(context.Background(), db, clock.Real())
 
 	server := gin.Default()
 	server.GET("/api/v1/libraries", getLibraries)
@@ -280,7 +285,13 @@ func decreaseBookCount(c *gin.Context) {
 	})
 }
 
+// increaseBookCount is retried by the gateway, so it honours idempotency
+// keys: a replayed request gets the original response without incrementing
+// the count again.
 func increaseBookCount(c *gin.Context) {
+	if idempotency.Replay(c, db) {
+		return
+	}
 	libraryUid := c.Param("libraryUid")
 	bookUid := c.Param("bookUid")
 
@@ -303,16 +314,27 @@ func increaseBookCount(c *gin.Context) {
 		return
 	}
 
-	libraryBook.AvailableCount++
-	if err := db.Save(&libraryBook).Error; err != nil {
+	var response gin.H
+	err := db.Transaction(func(tx *gorm.DB) error {
+		libraryBook.AvailableCount++
+		if err := tx.Save(&libraryBook).Error; err != nil {
+			return err
+		}
+		response = gin.H{
+			"bookUid":        book.BookUid,
+			"availableCount": libraryBook.AvailableCount,
+		}
+		return idempotency.Save(tx, c, http.StatusOK, response)
+	})
+	if errors.Is(err, idempotency.ErrKeyUsed) && idempotency.Replay(c, db) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book count"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"bookUid":        book.BookUid,
-		"availableCount": libraryBook.AvailableCount,
-	})
+	c.JSON(http.StatusOK, response)
 }
 
 func seedTestData() {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/idempotency"
 	"RSOI_lab_3/pkg/models"
 	"encoding/json"
 	"net/http"
@@ -18,7 +19,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect test database")
 	}
-	db.AutoMigrate(&models.Library{}, &models.Book{}, &models.LibraryBook{})
+	db.AutoMigrate(&models.Library{}, &models.Book{}, &models.LibraryBook{}, &models.IdempotencyKey{})
 	return db
 }
 
@@ -209,3 +210,33 @@ func TestIncreaseBookCount(t *testing.T) {
 	testDB.Where("library_id = ? AND book_id = ?", testLib.ID, testBook.ID).First(&updatedLibraryBook)
 	assert.Equal(t, 6, updatedLibraryBook.AvailableCount)
 }
+
+func TestIncreaseBookCountReplaysIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testDB := setupTestDB()
+	db = testDB
+
+	testLib := models.Library{LibraryUid: "test-lib-uid", Name: "Test Library", City: "Moscow", Address: "Test Address"}
+	testDB.Create(&testLib)
+	testBook := models.Book{BookUid: "test-book-uid", Name: "Test Book", Condition: "EXCELLENT"}
+	testDB.Create(&testBook)
+	testDB.Create(&models.LibraryBook{LibraryID: testLib.ID, BookID: testBook.ID, AvailableCount: 5})
+
+	r := gin.New()
+	r.POST("/api/v1/libraries/:libraryUid/books/:bookUid/increase", increaseBookCount)
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/libraries/test-lib-uid/books/test-book-uid/increase", nil)
+		req.Header.Set(idempotency.Header, "key-1")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		bodies = append(bodies, w.Body.String())
+		assert.Equal(t, i == 1, w.Header().Get(idempotency.ReplayedHeader) == "true")
+	}
+	assert.JSONEq(t, bodies[0], bodies[1])
+
+	var updatedLibraryBook models.LibraryBook
+	testDB.Where("library_id = ? AND book_id = ?", testLib.ID, testBook.ID).First(&updatedLibraryBook)
+	assert.Equal(t, 6, updatedLibraryBook.AvailableCount, "the replay is not applied again")
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/idempotency"
 	"RSOI_lab_3/pkg/models"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -46,7 +50,7 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	err = db.AutoMigrate(&models.Rating{})
+	err = db.AutoMigrate(&models.Rating{}, &models.IdempotencyKey{})
 	if err != nil {
 		log.Fatalf("Database migration failed: %v", err)
 	}
@@ -65,6 +69,7 @@ func main() {
 	log.Println("Database ping successful")
 
 	seedTestData()
+	go idempotency.RunPruner(context.Background(), db, clock.Real())
 
 	server := gin.Default()
 	server.GET("/api/v1/rating", getRating)
@@ -129,7 +134,14 @@ func updateRating(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"stars": rating.Stars})
 }
 
+// adjustRating is retried by the gateway, so it honours idempotency keys: a
+// replayed request gets the original response without applying the delta
+// again.
 func adjustRating(c *gin.Context) {
+	if idempotency.Replay(c, db) {
+		return
+	}
+
 	var request struct {
 		Username string `json:"username" binding:"required"`
 		Delta    int    `json:"delta"`
@@ -140,34 +152,44 @@ func adjustRating(c *gin.Context) {
 		return
 	}
 
-	var rating models.Rating
-	err = db.Where("username = ?", request.Username).First(&rating).Error
-	if err != nil {
-		rating = models.Rating{
-			Username: request.Username,
-			Stars:    1,
+	var response gin.H
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var rating models.Rating
+		err := tx.Where("username = ?", request.Username).First(&rating).Error
+		if err != nil {
+			rating = models.Rating{
+				Username: request.Username,
+				Stars:    1,
+			}
+			if err := tx.Create(&rating).Error; err != nil {
+				return err
+			}
+		}
+
+		newStars := rating.Stars + request.Delta
+		if newStars < 1 {
+			newStars = 1
 		}
-		if err := db.Create(&rating).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create rating"})
-			return
+		if newStars > 100 {
+			newStars = 100
 		}
-	}
 
-	newStars := rating.Stars + request.Delta
-	if newStars < 1 {
-		newStars = 1
-	}
-	if newStars > 100 {
-		newStars = 100
+		rating.Stars = newStars
+		if err := tx.Save(&rating).Error; err != nil {
+			return err
+		}
+		response = gin.H{"stars": rating.Stars}
+		return idempotency.Save(tx, c, http.StatusOK, response)
+	})
+	if errors.Is(err, idempotency.ErrKeyUsed) && idempotency.Replay(c, db) {
+		return
 	}
-
-	rating.Stars = newStars
-	if err := db.Save(&rating).Error; err != nil {
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update rating"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"stars": rating.Stars})
+	c.JSON(http.StatusOK, response)
 }
 
 func seedTestData() {
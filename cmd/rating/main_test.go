@@ -1,6 +1,7 @@
 package main
 
 import (
+	"RSOI_lab_3/pkg/idempotency"
 	"RSOI_lab_3/pkg/models"
 	"bytes"
 	"encoding/json"
@@ -19,7 +20,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect test database")
 	}
-	db.AutoMigrate(&models.Rating{})
+	db.AutoMigrate(&models.Rating{}, &models.IdempotencyKey{})
 	return db
 }
 
@@ -116,3 +117,36 @@ func TestUpdateRating(t *testing.T) {
 	testDB.Where("username = ?", "testuser").First(&updatedRating)
 	assert.Equal(t, 80, updatedRating.Stars)
 }
+
+func TestAdjustRatingReplaysIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testDB := setupTestDB()
+	db = testDB
+	testDB.Create(&models.Rating{Username: "testuser", Stars: 50})
+
+	r := gin.New()
+	r.POST("/api/v1/rating/adjust", adjustRating)
+	adjust := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/rating/adjust", bytes.NewBufferString(`{"username":"testuser","delta":-10}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotency.Header, key)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := adjust("key-1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.JSONEq(t, `{"stars":40}`, first.Body.String())
+
+	replay := adjust("key-1")
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.JSONEq(t, `{"stars":40}`, replay.Body.String())
+	assert.Equal(t, "true", replay.Header().Get(idempotency.ReplayedHeader))
+
+	assert.JSONEq(t, `{"stars":30}`, adjust("key-2").Body.String())
+
+	var rating models.Rating
+	testDB.Where("username = ?", "testuser").First(&rating)
+	assert.Equal(t, 30, rating.Stars)
+}
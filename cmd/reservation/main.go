@@ -71,6 +71,7 @@ func main() {
 	server.GET("/api/v1/reservations/active/count", getActiveReservationsCount)
 	server.POST("/api/v1/reservations", createReservations)
 	server.POST("/api/v1/reservations/:reservationUid/return", returnBook)
+	server.DELETE("/api/v1/reservations/:reservationUid/rollback", rollbackReservation)
 	server.GET("/manage/health", healthCheck)
 
 	log.Println("Reservation service starting on :8070")
@@ -228,6 +229,37 @@ func returnBook(c *gin.Context) {
 	c.Data(http.StatusNoContent, "application/json", nil)
 }
 
+// rollbackReservation deletes a reservation the gateway could not complete.
+// A reservation that is already gone counts as rolled back, so a repeated
+// rollback succeeds; one that was returned in the meantime is kept.
+func rollbackReservation(c *gin.Context) {
+	username := c.GetHeader("X-User-Name")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-User-Name header is required"})
+		return
+	}
+	reservationUid := c.Param("reservationUid")
+
+	result := db.Where("reservation_uid = ? AND username = ? AND status = ?", reservationUid, username, "RENTED").
+		Delete(&models.Reservation{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		if err := db.Model(&models.Reservation{}).Where("reservation_uid = ? AND username = ?", reservationUid, username).Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Reservation is no longer rented"})
+			return
+		}
+	}
+	c.Data(http.StatusNoContent, "application/json", nil)
+}
+
 func seedTestData() {
 	reservations := []models.Reservation{
 		{
@@ -247,3 +247,46 @@ func TestReturnBookExpired(t *testing.T) {
 	testDB.Where("reservation_uid = ?", "test-res-uid").First(&reservation)
 	assert.Equal(t, "EXPIRED", reservation.Status)
 }
+
+func TestRollbackReservation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testDB := setupTestDB()
+	db = testDB
+
+	testDB.Create(&models.Reservation{
+		ReservationUid: "rented-uid",
+		Username:       "testuser",
+		BookUid:        "test-book-uid",
+		LibraryUid:     "test-lib-uid",
+		Status:         "RENTED",
+		StartDate:      time.Now(),
+		TillDate:       time.Now().AddDate(0, 0, 7),
+	})
+	testDB.Create(&models.Reservation{
+		ReservationUid: "returned-uid",
+		Username:       "testuser",
+		BookUid:        "test-book-uid",
+		LibraryUid:     "test-lib-uid",
+		Status:         "RETURNED",
+		StartDate:      time.Now(),
+		TillDate:       time.Now().AddDate(0, 0, 7),
+	})
+
+	rollback := func(uid string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("DELETE", "/api/v1/reservations/"+uid+"/rollback", nil)
+		c.Request.Header.Set("X-User-Name", "testuser")
+		c.Params = gin.Params{gin.Param{Key: "reservationUid", Value: uid}}
+		rollbackReservation(c)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, rollback("rented-uid"))
+	assert.Equal(t, http.StatusNoContent, rollback("rented-uid"), "a repeated rollback succeeds")
+	assert.Equal(t, http.StatusConflict, rollback("returned-uid"))
+
+	var count int64
+	testDB.Model(&models.Reservation{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/queue"
+	"RSOI_lab_3/pkg/retryworker"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisClient *redis.Client
+	// breakerStore is set when the gateways share their breaker state
+	// (CIRCUIT_BREAKER_STORE=redis); requests to an endpoint whose breaker
+	// they opened are held back.
+	breakerStore circuitbreaker.Store
+	workerClock  clock.Clock = clock.Real()
+)
+
+const (
+	defaultWorkers = 4
+	healthTimeout  = time.Second
+	breakerTimeout = 100 * time.Millisecond
+)
+
+func main() {
+	redisHost := getEnv("REDIS_HOST", "localhost")
+	redisPort := getEnv("REDIS_PORT", "6379")
+	redisAddr := redisHost + ":" + redisPort
+
+	redisClient = redis.NewClient(&redis.Options{
+		Addr:     redisAddr,
+		Password: "",
+		DB:       0,
+	})
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		// The worker backs off until the queue can be read.
+		log.Printf("Redis at %s is unavailable: %v", redisAddr, err)
+	} else {
+		log.Printf("Connected to Redis at %s", redisAddr)
+	}
+
+	workers, err := strconv.Atoi(getEnv("RETRY_WORKERS", strconv.Itoa(defaultWorkers)))
+	if err != nil || workers < 1 {
+		log.Fatalf("RETRY_WORKERS must be a positive number, got %q", os.Getenv("RETRY_WORKERS"))
+	}
+	if getEnv("CIRCUIT_BREAKER_STORE", "local") == "redis" {
+		breakerStore = circuitbreaker.NewRedisStore(redisClient, "")
+		log.Println("Holding back retries to endpoints whose circuit breaker is open")
+	}
+
+	retryQueue := queue.NewQueueWithBackend(newQueueBackend(redisClient), queue.WithClock(workerClock))
+	worker := retryworker.New(retryQueue, &http.Client{Timeout: 10 * time.Second},
+		retryworker.WithClock(workerClock),
+		retryworker.WithConcurrency(workers),
+		retryworker.WithPause(isEndpointOpen),
+	)
+	go worker.Run(context.Background())
+	log.Printf("Delivering retries with %d workers", workers)
+
+	r := gin.Default()
+	r.GET("/manage/health", healthCheck)
+
+	log.Println("Retry worker service starting on port 8090")
+	if err := r.Run(":8090"); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// newQueueBackend reads the queue the gateways write to, in the layout
+// selected by RETRY_QUEUE_BACKEND as in the gateway.
+func newQueueBackend(redisClient *redis.Client) queue.Backend {
+	if getEnv("RETRY_QUEUE_BACKEND", "sorted-set") == "streams" {
+		host, _ := os.Hostname()
+		return queue.NewStreamBackend(redisClient, "", fmt.Sprintf("retryworker-%s-%d", host, os.Getpid()))
+	}
+	return queue.NewRedisBackend(redisClient, "")
+}
+
+// isEndpointOpen reports whether the gateways opened the breaker of the
+// endpoint req targets. Without a shared store, or if it cannot be read,
+// requests are delivered.
+func isEndpointOpen(req *queue.RetryRequest) bool {
+	if breakerStore == nil || req.Breaker == "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), breakerTimeout)
+	defer cancel()
+	shared, err := breakerStore.Load(ctx, req.Breaker)
+	if err != nil {
+		return false
+	}
+	return shared.State == circuitbreaker.StateOpen && workerClock.Now().Before(shared.OpenUntil)
+}
+
+func healthCheck(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthTimeout)
+	defer cancel()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "DOWN",
+			"details": "Redis ping failed",
+			"error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "UP",
+		"details": "Host localhost:8090 is active",
+	})
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
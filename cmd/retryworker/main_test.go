@@ -0,0 +1,62 @@
+package main
+
+import (
+	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/queue"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckReportsRedis(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr := miniredis.RunT(t)
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	r := gin.New()
+	r.GET("/manage/health", healthCheck)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"UP"`)
+
+	mr.Close()
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/manage/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"DOWN"`)
+}
+
+func TestIsEndpointOpenFollowsSharedBreakers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	workerClock = fake
+	store := circuitbreaker.NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	breakerStore = store
+	defer func() {
+		workerClock = clock.Real()
+		breakerStore = nil
+	}()
+
+	req := &queue.RetryRequest{Breaker: "rating POST /api/v1/rating/adjust"}
+	assert.False(t, isEndpointOpen(req))
+
+	assert.NoError(t, store.Save(context.Background(), req.Breaker, circuitbreaker.SharedState{
+		State:     circuitbreaker.StateOpen,
+		OpenUntil: fake.Now().Add(30 * time.Second),
+		UpdatedAt: fake.Now(),
+	}))
+	assert.True(t, isEndpointOpen(req))
+	assert.False(t, isEndpointOpen(&queue.RetryRequest{Breaker: "library GET /api/v1/libraries"}))
+
+	fake.Advance(30 * time.Second)
+	assert.False(t, isEndpointOpen(req))
+}
@@ -0,0 +1,91 @@
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBulkheadFull is returned when all slots are busy and the wait queue is
+// full, or the caller waited longer than the bulkhead's maximum wait.
+var ErrBulkheadFull = errors.New("bulkhead is full")
+
+// Bulkhead limits the number of concurrent calls to one dependency, so a
+// flood of requests to it cannot starve calls to the others.
+type Bulkhead struct {
+	slots      chan struct{}
+	maxWaiting int
+	maxWait    time.Duration
+	waiting    int
+	mu         sync.Mutex
+}
+
+// NewBulkhead admits maxConcurrent calls at once. Up to maxWaiting more may
+// wait for a slot, each for at most maxWait; anything beyond is rejected.
+func NewBulkhead(maxConcurrent, maxWaiting int, maxWait time.Duration) *Bulkhead {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	if maxWaiting < 0 {
+		maxWaiting = 0
+	}
+	return &Bulkhead{
+		slots:      make(chan struct{}, maxConcurrent),
+		maxWaiting: maxWaiting,
+		maxWait:    maxWait,
+	}
+}
+
+// Acquire takes a slot and returns the function that gives it back.
+func (b *Bulkhead) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case b.slots <- struct{}{}:
+		return b.release, nil
+	default:
+	}
+
+	b.mu.Lock()
+	if b.waiting >= b.maxWaiting {
+		b.mu.Unlock()
+		return nil, ErrBulkheadFull
+	}
+	b.waiting++
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.waiting--
+		b.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return b.release, nil
+	case <-timer.C:
+		return nil, ErrBulkheadFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Execute runs fn in a slot, or returns the error that prevented taking one.
+func (b *Bulkhead) Execute(ctx context.Context, fn func(ctx context.Context) error) error {
+	release, err := b.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn(ctx)
+}
+
+// InFlight returns the number of calls currently holding a slot.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+func (b *Bulkhead) release() {
+	<-b.slots
+}
@@ -0,0 +1,71 @@
+package bulkhead
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkheadRejectsWhenQueueFull(t *testing.T) {
+	b := NewBulkhead(1, 0, time.Second)
+
+	release, err := b.Acquire(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.InFlight())
+
+	_, err = b.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrBulkheadFull)
+
+	release()
+	release, err = b.Acquire(context.Background())
+	assert.NoError(t, err)
+	release()
+}
+
+func TestBulkheadQueuedCallGetsFreedSlot(t *testing.T) {
+	b := NewBulkhead(1, 1, time.Second)
+	release, _ := b.Acquire(context.Background())
+
+	acquired := make(chan error)
+	go func() {
+		release, err := b.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	_, err := b.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrBulkheadFull)
+
+	release()
+	assert.NoError(t, <-acquired)
+}
+
+func TestBulkheadWaitTimeout(t *testing.T) {
+	b := NewBulkhead(1, 1, 10*time.Millisecond)
+	release, _ := b.Acquire(context.Background())
+	defer release()
+
+	err := b.Execute(context.Background(), func(ctx context.Context) error { return nil })
+	assert.ErrorIs(t, err, ErrBulkheadFull)
+}
+
+func TestBulkheadWaitHonoursContext(t *testing.T) {
+	b := NewBulkhead(1, 1, time.Minute)
+	release, _ := b.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := b.Acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -1,8 +1,12 @@
 package circuitbreaker
 
 import (
+	"RSOI_lab_3/pkg/clock"
+	"context"
 	"errors"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,79 +18,489 @@ const (
 	StateHalfOpen
 )
 
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrOpenState is returned when the breaker rejects a call because it is open.
+	ErrOpenState = errors.New("circuit breaker is open")
+	// ErrTooManyRequests is returned when the breaker is half-open and all probe slots are taken.
+	ErrTooManyRequests = errors.New("circuit breaker is half-open: too many requests")
+)
+
+const (
+	defaultHalfOpenMaxCalls = 1
+	// statsBuckets is how many buckets the count-mode statistics window
+	// is split into.
+	statsBuckets = 10
+)
+
+// Counts are the call statistics of the breaker's current window.
+type Counts struct {
+	Calls     int
+	Failures  int
+	SlowCalls int
+}
+
+// CircuitBreaker guards calls to a remote dependency. The mutex is only held
+// while the state is inspected or updated, never while fn is running, so
+// concurrent calls through the same breaker do not block each other.
 type CircuitBreaker struct {
-	maxFailures     int
-	window          time.Duration
-	failures        []time.Time
-	timeout         time.Duration
-	lastFailureTime time.Time
-	state           State
-	mu              sync.RWMutex
+	name        string
+	clock       clock.Clock
+	maxFailures int
+	window      time.Duration
+	failures    []time.Time
+	// stats aggregates call outcomes. In failure-rate mode it also replaces
+	// the maxFailures/window/failures count mode for tripping.
+	stats                slidingWindow
+	rateMode             bool
+	failureRateThreshold float64
+	minCalls             int
+	slowCallDuration     time.Duration
+	slowCallRateLimit    float64
+	timeout              time.Duration
+	halfOpenMaxCalls     int
+	callTimeout          time.Duration
+	isFailure            FailureClassifier
+	lastFailureTime      time.Time
+	// openUntil is when an open breaker lets the next probe through.
+	// openTimeout is the un-jittered timeout used for the current open
+	// period; it grows with every failed probe when backoff is enabled.
+	openUntil         time.Time
+	openTimeout       time.Duration
+	backoffMultiplier float64
+	maxOpenTimeout    time.Duration
+	backoffJitter     float64
+	state             State
+	stateChangedAt    time.Time
+	// forced pins the state set by ForceOpen or ForceClose until Reset.
+	forced bool
+	// generation is bumped on every state change so results of calls that
+	// were admitted under a previous state are not counted against the new one.
+	generation        uint64
+	halfOpenCalls     int
+	halfOpenSuccesses int
+	listeners         map[int]Listener
+	nextListenerID    int
+	// pending holds transitions made under mu; unlock delivers them.
+	pending           []StateChange
+	store             Store
+	storeSyncInterval time.Duration
+	lastSync          time.Time
+	syncing           atomic.Bool
+	mu                sync.RWMutex
+	subscribersMu     sync.RWMutex
+}
+
+// Option customises a CircuitBreaker at construction time.
+type Option func(*CircuitBreaker)
+
+// WithHalfOpenMaxCalls sets how many probe calls are admitted while the
+// breaker is half-open. The breaker closes once that many probes succeed;
+// calls beyond the limit get the fallback immediately.
+func WithHalfOpenMaxCalls(n int) Option {
+	return func(cb *CircuitBreaker) {
+		if n > 0 {
+			cb.halfOpenMaxCalls = n
+		}
+	}
+}
+
+// WithCallTimeout bounds every call made through ExecuteContext or Call.
+// The deadline is applied on top of the caller's context, so the shorter of
+// the two wins. Calls that run out of time are recorded as failures.
+func WithCallTimeout(d time.Duration) Option {
+	return func(cb *CircuitBreaker) {
+		if d > 0 {
+			cb.callTimeout = d
+		}
+	}
+}
+
+// WithFailureClassifier sets which errors count against the dependency.
+// Errors the classifier rejects are still returned to the caller but are
+// recorded as successful calls. By default every non-nil error is a failure.
+func WithFailureClassifier(classifier FailureClassifier) Option {
+	return func(cb *CircuitBreaker) {
+		if classifier != nil {
+			cb.isFailure = classifier
+		}
+	}
+}
+
+// WithFailureRate switches the breaker from counting failures to tripping
+// when at least threshold percent of the calls in window failed. The rate is
+// only evaluated once the window holds minCalls calls, so a couple of errors
+// under low traffic do not open the breaker.
+func WithFailureRate(threshold float64, minCalls int, window Window) Option {
+	return func(cb *CircuitBreaker) {
+		if minCalls < 1 {
+			minCalls = 1
+		}
+		cb.rateMode = true
+		cb.failureRateThreshold = threshold
+		cb.minCalls = minCalls
+		cb.stats = window.newSlidingWindow()
+	}
+}
+
+// WithSlowCalls records calls that take longer than duration as slow and
+// opens the breaker once at least rateLimit percent of the calls in the
+// window were slow. A slow half-open probe reopens the breaker. In count
+// mode the rate is evaluated once the window holds maxFailures+1 calls.
+func WithSlowCalls(duration time.Duration, rateLimit float64) Option {
+	return func(cb *CircuitBreaker) {
+		if duration > 0 {
+			cb.slowCallDuration = duration
+			cb.slowCallRateLimit = rateLimit
+		}
+	}
+}
+
+// WithOpenBackoff makes the breaker stay open longer every time a half-open
+// probe fails: the open timeout is multiplied by multiplier up to
+// maxTimeout, and randomised by up to ±jitter (a fraction, e.g. 0.2) so
+// replicas do not probe in lockstep. The timeout goes back to its initial
+// value once the breaker closes.
+func WithOpenBackoff(multiplier float64, maxTimeout time.Duration, jitter float64) Option {
+	return func(cb *CircuitBreaker) {
+		if multiplier > 1 {
+			cb.backoffMultiplier = multiplier
+			cb.maxOpenTimeout = maxTimeout
+		}
+		if jitter > 0 && jitter < 1 {
+			cb.backoffJitter = jitter
+		}
+	}
 }
 
-func NewCircuitBreaker(maxFailures int, timeout time.Duration) *CircuitBreaker {
-	return NewCircuitBreakerWithWindow(maxFailures, timeout, 60*time.Second)
+// WithClock replaces the wall clock used for windows, open timeouts and
+// slow-call detection. Call timeouts (WithCallTimeout) still use real time.
+func WithClock(c clock.Clock) Option {
+	return func(cb *CircuitBreaker) {
+		if c != nil {
+			cb.clock = c
+		}
+	}
 }
 
-func NewCircuitBreakerWithWindow(maxFailures int, timeout time.Duration, window time.Duration) *CircuitBreaker {
-	return &CircuitBreaker{
-		maxFailures: maxFailures,
-		window:      window,
-		timeout:     timeout,
-		state:       StateClosed,
-		failures:    make([]time.Time, 0),
+func NewCircuitBreaker(maxFailures int, timeout time.Duration, opts ...Option) *CircuitBreaker {
+	return NewCircuitBreakerWithWindow(maxFailures, timeout, 60*time.Second, opts...)
+}
+
+func NewCircuitBreakerWithWindow(maxFailures int, timeout time.Duration, window time.Duration, opts ...Option) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		clock:            clock.Real(),
+		maxFailures:      maxFailures,
+		window:           window,
+		stats:            TimeWindow(window, statsBuckets).newSlidingWindow(),
+		minCalls:         maxFailures + 1,
+		timeout:          timeout,
+		halfOpenMaxCalls: defaultHalfOpenMaxCalls,
+		isFailure:        IsAnyError,
+		state:            StateClosed,
+		failures:         make([]time.Time, 0),
+	}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	if cb.store != nil {
+		cb.OnStateChange(cb.pushState)
 	}
+	return cb
 }
 
+// Execute runs fn if the breaker admits the call and records its outcome.
+// When the call is rejected, fallback is run instead (if provided) and its
+// result is returned; otherwise ErrOpenState or ErrTooManyRequests is returned.
 func (cb *CircuitBreaker) Execute(fn func() error, fallback func() error) error {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
+	var fallbackCtx func(context.Context, error) error
+	if fallback != nil {
+		fallbackCtx = func(context.Context, error) error { return fallback() }
+	}
+	return cb.ExecuteContext(context.Background(),
+		func(context.Context) error { return fn() },
+		fallbackCtx,
+	)
+}
+
+// ExecuteContext is the context-aware form of Execute. fn receives a context
+// derived from ctx (bounded by WithCallTimeout if set) and must not use it
+// after returning. If ctx is already done the call is not attempted and
+// ctx.Err() is returned. A call that fails only because the caller cancelled
+// ctx, or whose error the failure classifier rejects, is not held against the
+// dependency.
+func (cb *CircuitBreaker) ExecuteContext(ctx context.Context, fn func(ctx context.Context) error, fallback func(ctx context.Context, err error) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if cb.state == StateOpen {
-		if time.Since(cb.lastFailureTime) >= cb.timeout {
-			cb.state = StateHalfOpen
-			cb.failures = cb.failures[:0]
-		} else {
-			cb.mu.Unlock()
-			if fallback != nil {
-				err := fallback()
-				cb.mu.Lock()
-				return err
-			}
-			cb.mu.Lock()
-			return errors.New("circuit breaker is open")
+	cb.pullState()
+	generation, err := cb.beforeCall()
+	if err != nil {
+		if fallback != nil {
+			return fallback(ctx, err)
 		}
+		return err
 	}
 
-	err := fn()
+	callCtx, cancel := cb.callContext(ctx)
+	defer cancel()
 
+	defer func() {
+		if r := recover(); r != nil {
+			cb.afterCall(generation, outcome{failed: true})
+			panic(r)
+		}
+	}()
+
+	start := cb.clock.Now()
+	err = fn(callCtx)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		cb.release(generation)
+		return err
+	}
+	o := outcome{
+		failed: err != nil && cb.isFailure(err),
+		slow:   cb.slowCallDuration > 0 && cb.clock.Since(start) > cb.slowCallDuration,
+	}
+	cb.afterCall(generation, o)
+	if o.failed {
+		cb.shareFailure(generation)
+	}
+	return err
+}
+
+// Call runs fn through cb and returns its value. fallback, if provided, is
+// invoked both when the breaker rejects the call and when fn fails, and
+// receives the reason; its result replaces fn's. Without a fallback the zero
+// value and the error are returned. Errors the failure classifier rejects
+// skip the fallback and are returned together with fn's value.
+func Call[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error), fallback func(ctx context.Context, err error) (T, error)) (T, error) {
+	var result T
+	err := cb.ExecuteContext(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	}, nil)
 	if err != nil {
-		now := time.Now()
-		cb.lastFailureTime = now
+		if !isRejection(err) && !cb.isFailure(err) {
+			return result, err
+		}
+		if fallback != nil && ctx.Err() == nil {
+			return fallback(ctx, err)
+		}
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+func isRejection(err error) bool {
+	return errors.Is(err, ErrOpenState) || errors.Is(err, ErrTooManyRequests)
+}
+
+func (cb *CircuitBreaker) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cb.callTimeout > 0 {
+		return context.WithTimeout(ctx, cb.callTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Allow returns the error a call made now would be rejected with, or nil if
+// it would be let through. It takes no half-open probe slot, so the call
+// itself may still be rejected; it lets callers skip work, such as waiting
+// for a bulkhead, on behalf of a call that cannot run.
+func (cb *CircuitBreaker) Allow() error {
+	cb.pullState()
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	switch cb.currentState(cb.clock.Now()) {
+	case StateOpen:
+		return ErrOpenState
+	case StateHalfOpen:
+		if cb.halfOpenCalls >= cb.halfOpenMaxCalls {
+			return ErrTooManyRequests
+		}
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) beforeCall() (uint64, error) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	switch cb.currentState(cb.clock.Now()) {
+	case StateOpen:
+		return cb.generation, ErrOpenState
+	case StateHalfOpen:
+		if cb.halfOpenCalls >= cb.halfOpenMaxCalls {
+			return cb.generation, ErrTooManyRequests
+		}
+		cb.halfOpenCalls++
+	}
+	return cb.generation, nil
+}
+
+func (cb *CircuitBreaker) afterCall(generation uint64, o outcome) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	now := cb.clock.Now()
+	state := cb.currentState(now)
+	if generation != cb.generation {
+		return
+	}
+
+	cb.stats.record(now, o)
+	if cb.forced {
+		if o.failed {
+			cb.lastFailureTime = now
+		}
+		return
+	}
+	if o.failed {
+		cb.onFailure(state, now)
+	} else {
+		cb.onSuccess(state, o.slow, now)
+	}
+}
+
+// release frees a half-open probe slot without recording an outcome.
+func (cb *CircuitBreaker) release(generation uint64) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	if generation == cb.generation && cb.state == StateHalfOpen && cb.halfOpenCalls > 0 {
+		cb.halfOpenCalls--
+	}
+}
+
+func (cb *CircuitBreaker) onSuccess(state State, slow bool, now time.Time) {
+	if !cb.rateMode {
+		cb.cleanOldFailures(now)
+	}
+
+	if slow {
+		if state == StateHalfOpen {
+			cb.trip(state, now, ReasonProbeSlow)
+			return
+		}
+		if reason := cb.shouldTrip(now); reason != "" {
+			cb.trip(state, now, reason)
+			return
+		}
+	}
+
+	if state == StateHalfOpen {
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.halfOpenMaxCalls {
+			cb.setState(StateClosed, now, ReasonProbesSucceeded)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) onFailure(state State, now time.Time) {
+	cb.lastFailureTime = now
+	if !cb.rateMode {
 		cb.failures = append(cb.failures, now)
 		cb.cleanOldFailures(now)
+	}
 
-		if len(cb.failures) > cb.maxFailures || cb.state == StateHalfOpen {
-			cb.state = StateOpen
+	if state == StateHalfOpen {
+		cb.trip(state, now, ReasonProbeFailed)
+	} else if reason := cb.shouldTrip(now); reason != "" {
+		cb.trip(state, now, reason)
+	}
+}
+
+// trip opens the breaker. A failed half-open probe backs the open timeout
+// off; tripping from closed starts again from the configured timeout.
+func (cb *CircuitBreaker) trip(from State, now time.Time, reason string) {
+	if from == StateHalfOpen && cb.backoffMultiplier > 1 && cb.openTimeout > 0 {
+		cb.openTimeout = time.Duration(float64(cb.openTimeout) * cb.backoffMultiplier)
+		if cb.maxOpenTimeout > 0 && cb.openTimeout > cb.maxOpenTimeout {
+			cb.openTimeout = cb.maxOpenTimeout
 		}
-		return err
+	} else {
+		cb.openTimeout = cb.timeout
 	}
 
-	cb.cleanOldFailures(time.Now())
+	wait := cb.openTimeout
+	if cb.backoffJitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * cb.backoffJitter * float64(wait))
+	}
+	cb.openUntil = now.Add(wait)
+	cb.setState(StateOpen, now, reason)
+}
 
-	if cb.state == StateHalfOpen {
-		cb.state = StateClosed
-		cb.failures = cb.failures[:0]
+// shouldTrip returns why the breaker has to open, or "" if it does not.
+func (cb *CircuitBreaker) shouldTrip(now time.Time) string {
+	if !cb.rateMode && len(cb.failures) > cb.maxFailures {
+		return ReasonFailureThreshold
+	}
+	counts := cb.stats.counts(now)
+	if counts.calls < cb.minCalls {
+		return ""
 	}
+	if cb.rateMode && counts.failureRate() >= cb.failureRateThreshold {
+		return ReasonFailureRate
+	}
+	if cb.slowCallDuration > 0 && counts.slowCallRate() >= cb.slowCallRateLimit {
+		return ReasonSlowCallRate
+	}
+	return ""
+}
 
-	return nil
+// currentState returns the state at now, moving an expired open breaker to
+// half-open. Must be called with cb.mu held for writing.
+func (cb *CircuitBreaker) currentState(now time.Time) State {
+	if cb.state == StateOpen && !cb.forced && !now.Before(cb.openUntil) {
+		cb.setState(StateHalfOpen, now, ReasonOpenTimeout)
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) setState(state State, now time.Time, reason string) {
+	if cb.state == state {
+		return
+	}
+	cb.pending = append(cb.pending, StateChange{
+		Name:   cb.name,
+		From:   cb.state,
+		To:     state,
+		Reason: reason,
+		Counts: cb.stats.counts(now).export(),
+		At:     now,
+	})
+	cb.state = state
+	cb.stateChangedAt = now
+	cb.generation++
+	cb.halfOpenCalls = 0
+	cb.halfOpenSuccesses = 0
+	if state != StateOpen {
+		cb.failures = cb.failures[:0]
+		cb.stats.reset()
+	}
 }
 
 func (cb *CircuitBreaker) cleanOldFailures(now time.Time) {
 	cutoff := now.Add(-cb.window)
-	validStart := 0
-	for i := len(cb.failures) - 1; i >= 0; i-- {
-		if cb.failures[i].After(cutoff) {
+	validStart := len(cb.failures)
+	for i, failure := range cb.failures {
+		if failure.After(cutoff) {
 			validStart = i
 			break
 		}
@@ -96,8 +510,15 @@ func (cb *CircuitBreaker) cleanOldFailures(now time.Time) {
 	}
 }
 
+// Counts returns the call, failure and slow-call counts of the current window.
+func (cb *CircuitBreaker) Counts() Counts {
+	cb.mu.Lock()
+	defer cb.unlock()
+	return cb.stats.counts(cb.clock.Now()).export()
+}
+
 func (cb *CircuitBreaker) GetState() State {
-	cb.mu.RLock()
-	defer cb.mu.RUnlock()
-	return cb.state
+	cb.mu.Lock()
+	defer cb.unlock()
+	return cb.currentState(cb.clock.Now())
 }
@@ -0,0 +1,514 @@
+package circuitbreaker
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errUpstream = errors.New("upstream failed")
+
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func failN(cb *CircuitBreaker, n int) {
+	for i := 0; i < n; i++ {
+		cb.Execute(func() error { return errUpstream }, nil)
+	}
+}
+
+func TestCircuitBreakerOpensAfterMaxFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+
+	failN(cb, 2)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+
+	called := false
+	err := cb.Execute(func() error {
+		called = true
+		return nil
+	}, nil)
+	assert.False(t, called)
+	assert.ErrorIs(t, err, ErrOpenState)
+}
+
+func TestCircuitBreakerFallbackWhenOpen(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	failN(cb, 1)
+
+	fallbackCalled := false
+	err := cb.Execute(func() error { return nil }, func() error {
+		fallbackCalled = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, fallbackCalled)
+}
+
+func TestCircuitBreakerDoesNotSerializeCalls(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go cb.Execute(func() error {
+		close(started)
+		<-release
+		return nil
+	}, nil)
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		cb.Execute(func() error { return nil }, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second call blocked behind the first one")
+	}
+	close(release)
+}
+
+func TestCircuitBreakerHalfOpenLimitsProbes(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, 30*time.Second, WithHalfOpenMaxCalls(2), WithClock(c))
+	failN(cb, 1)
+	c.Advance(30 * time.Second)
+	assert.Equal(t, StateHalfOpen, cb.GetState())
+
+	release := make(chan struct{})
+	var admitted, rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cb.Execute(func() error {
+				atomic.AddInt32(&admitted, 1)
+				<-release
+				return nil
+			}, func() error {
+				atomic.AddInt32(&rejected, 1)
+				return nil
+			})
+		}()
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&admitted)+atomic.LoadInt32(&rejected) == 5
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&admitted))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&rejected))
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, StateClosed, cb.GetState())
+}
+
+func TestAllowReportsRejection(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, 30*time.Second, WithClock(c))
+	assert.NoError(t, cb.Allow())
+
+	failN(cb, 1)
+	assert.ErrorIs(t, cb.Allow(), ErrOpenState)
+
+	c.Advance(30 * time.Second)
+	assert.NoError(t, cb.Allow())
+	assert.NoError(t, cb.Allow(), "Allow takes no probe slot")
+
+	release := make(chan struct{})
+	go cb.Execute(func() error {
+		<-release
+		return nil
+	}, nil)
+	assert.Eventually(t, func() bool {
+		return errors.Is(cb.Allow(), ErrTooManyRequests)
+	}, time.Second, time.Millisecond)
+	close(release)
+}
+
+func TestCircuitBreakerHalfOpenFailureReopens(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, 30*time.Second, WithClock(c))
+	failN(cb, 1)
+	c.Advance(29 * time.Second)
+	assert.Equal(t, StateOpen, cb.GetState())
+	c.Advance(time.Second)
+	assert.Equal(t, StateHalfOpen, cb.GetState())
+
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestCircuitBreakerIgnoresStaleResults(t *testing.T) {
+	cb := NewCircuitBreaker(0, 10*time.Millisecond)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		cb.Execute(func() error {
+			close(started)
+			<-release
+			return nil
+		}, nil)
+		close(done)
+	}()
+	<-started
+
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+
+	close(release)
+	<-done
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestCallReturnsValue(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+
+	value, err := Call(context.Background(), cb, func(ctx context.Context) (int, error) {
+		return 42, nil
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, value)
+}
+
+func TestCallFallbackOnFailureAndRejection(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	fallback := func(ctx context.Context, err error) (string, error) {
+		return "fallback: " + err.Error(), nil
+	}
+
+	value, err := Call(context.Background(), cb, func(ctx context.Context) (string, error) {
+		return "", errUpstream
+	}, fallback)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback: "+errUpstream.Error(), value)
+
+	value, err = Call(context.Background(), cb, func(ctx context.Context) (string, error) {
+		return "live", nil
+	}, fallback)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback: "+ErrOpenState.Error(), value)
+}
+
+func TestExecuteContextSkipsDoneContext(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	err := cb.ExecuteContext(ctx, func(ctx context.Context) error {
+		called = true
+		return nil
+	}, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, called)
+	assert.Equal(t, StateClosed, cb.GetState())
+}
+
+func TestExecuteContextCallerCancelIsNotAFailure(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := cb.ExecuteContext(ctx, func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StateClosed, cb.GetState())
+}
+
+func TestExecuteContextCallTimeout(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute, WithCallTimeout(10*time.Millisecond))
+
+	err := cb.ExecuteContext(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestFailureClassifierIgnoresClientErrors(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute, WithFailureClassifier(IsServerFailure))
+	notFound := &HTTPStatusError{StatusCode: 404, Body: []byte(`{"error":"not found"}`)}
+
+	fallbackCalled := false
+	value, err := Call(context.Background(), cb, func(ctx context.Context) (string, error) {
+		return "partial", notFound
+	}, func(ctx context.Context, err error) (string, error) {
+		fallbackCalled = true
+		return "", nil
+	})
+	assert.ErrorIs(t, err, notFound)
+	assert.Equal(t, "partial", value)
+	assert.False(t, fallbackCalled)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	cb.Execute(func() error { return &HTTPStatusError{StatusCode: 503} }, nil)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestIsServerFailure(t *testing.T) {
+	assert.False(t, IsServerFailure(nil))
+	assert.True(t, IsServerFailure(errUpstream))
+	assert.True(t, IsServerFailure(context.DeadlineExceeded))
+	assert.False(t, IsServerFailure(fmt.Errorf("wrapped: %w", context.Canceled)))
+	assert.True(t, IsServerFailure(&HTTPStatusError{StatusCode: 500}))
+	assert.False(t, IsServerFailure(&HTTPStatusError{StatusCode: 400}))
+	assert.False(t, IsServerFailure(fmt.Errorf("wrapped: %w", &HTTPStatusError{StatusCode: 404})))
+}
+
+func succeedN(cb *CircuitBreaker, n int) {
+	for i := 0; i < n; i++ {
+		cb.Execute(func() error { return nil }, nil)
+	}
+}
+
+func TestFailureRateRespectsMinCalls(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute, WithFailureRate(50, 4, CountWindow(10)))
+
+	failN(cb, 3)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestFailureRateCountWindow(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute, WithFailureRate(50, 4, CountWindow(4)))
+
+	succeedN(cb, 3)
+	failN(cb, 1)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	// The window slides: two successes drop out, two failures come in.
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestFailureRateTimeWindowExpires(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, time.Minute, WithFailureRate(60, 2, TimeWindow(40*time.Second, 4)), WithClock(c))
+
+	failN(cb, 1)
+	c.Advance(40 * time.Second)
+	succeedN(cb, 1)
+	failN(cb, 1)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestCountWindowRing(t *testing.T) {
+	w := CountWindow(3).newSlidingWindow()
+	w.record(time.Time{}, outcome{failed: true})
+	w.record(time.Time{}, outcome{failed: true, slow: true})
+	w.record(time.Time{}, outcome{})
+	w.record(time.Time{}, outcome{slow: true})
+
+	assert.Equal(t, windowCounts{calls: 3, failures: 1, slowCalls: 2}, w.counts(time.Time{}))
+}
+
+func slowCall(c *clock.Fake, d time.Duration) func() error {
+	return func() error {
+		c.Advance(d)
+		return nil
+	}
+}
+
+func TestSlowCallsOpenBreaker(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, time.Minute,
+		WithFailureRate(50, 2, CountWindow(10)),
+		WithSlowCalls(5*time.Second, 60),
+		WithClock(c),
+	)
+
+	cb.Execute(slowCall(c, 5*time.Second), nil)
+	assert.Equal(t, Counts{Calls: 1}, cb.Counts())
+
+	cb.Execute(slowCall(c, 9*time.Second), nil)
+	assert.Equal(t, StateClosed, cb.GetState())
+	assert.Equal(t, Counts{Calls: 2, SlowCalls: 1}, cb.Counts())
+
+	cb.Execute(slowCall(c, 9*time.Second), nil)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestSlowCallsBelowLimit(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(1, time.Minute, WithSlowCalls(5*time.Second, 60), WithClock(c))
+
+	cb.Execute(slowCall(c, 9*time.Second), nil)
+	succeedN(cb, 1)
+	failN(cb, 1)
+	assert.Equal(t, StateClosed, cb.GetState())
+	assert.Equal(t, Counts{Calls: 3, Failures: 1, SlowCalls: 1}, cb.Counts())
+}
+
+func TestSlowHalfOpenProbeReopens(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, 30*time.Second, WithSlowCalls(5*time.Second, 100), WithClock(c))
+	failN(cb, 1)
+	c.Advance(30 * time.Second)
+
+	cb.Execute(slowCall(c, 9*time.Second), nil)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestOpenBackoffGrowsAndResets(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, 10*time.Second, WithOpenBackoff(3, 50*time.Second, 0), WithClock(c))
+
+	failN(cb, 1)
+	c.Advance(10 * time.Second)
+	assert.Equal(t, StateHalfOpen, cb.GetState())
+
+	// The failed probe reopens the breaker for 30s instead of 10s.
+	failN(cb, 1)
+	c.Advance(29 * time.Second)
+	assert.Equal(t, StateOpen, cb.GetState())
+	c.Advance(time.Second)
+	assert.Equal(t, StateHalfOpen, cb.GetState())
+
+	// The next one is capped at 50s.
+	failN(cb, 1)
+	c.Advance(49 * time.Second)
+	assert.Equal(t, StateOpen, cb.GetState())
+	c.Advance(time.Second)
+
+	succeedN(cb, 1)
+	assert.Equal(t, StateClosed, cb.GetState())
+
+	failN(cb, 1)
+	c.Advance(10 * time.Second)
+	assert.Equal(t, StateHalfOpen, cb.GetState())
+}
+
+func TestOpenBackoffJitterStaysInRange(t *testing.T) {
+	cb := NewCircuitBreaker(0, 100*time.Millisecond, WithOpenBackoff(2, time.Second, 0.2))
+
+	for i := 0; i < 20; i++ {
+		now := time.Now()
+		cb.mu.Lock()
+		cb.trip(StateClosed, now, ReasonFailureThreshold)
+		wait := cb.openUntil.Sub(now)
+		cb.mu.Unlock()
+		assert.GreaterOrEqual(t, wait, 80*time.Millisecond)
+		assert.LessOrEqual(t, wait, 120*time.Millisecond)
+	}
+}
+
+func TestStateChangeListener(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(1, 30*time.Second, WithName("library"), WithClock(c))
+
+	var changes []StateChange
+	unregister := cb.OnStateChange(func(change StateChange) {
+		// Listeners run outside the lock and may query the breaker.
+		assert.Equal(t, change.To, cb.GetState())
+		changes = append(changes, change)
+	})
+
+	failN(cb, 2)
+	c.Advance(30 * time.Second)
+	succeedN(cb, 1)
+
+	if assert.Len(t, changes, 3) {
+		assert.Equal(t, StateChange{
+			Name:   "library",
+			From:   StateClosed,
+			To:     StateOpen,
+			Reason: ReasonFailureThreshold,
+			Counts: Counts{Calls: 2, Failures: 2},
+			At:     c.Now().Add(-30 * time.Second),
+		}, changes[0])
+		assert.Equal(t, ReasonOpenTimeout, changes[1].Reason)
+		assert.Equal(t, StateHalfOpen, changes[1].To)
+		assert.Equal(t, ReasonProbesSucceeded, changes[2].Reason)
+		assert.Equal(t, StateClosed, changes[2].To)
+	}
+
+	unregister()
+	failN(cb, 2)
+	assert.Len(t, changes, 3)
+}
+
+func TestSubscribe(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	events, unsubscribe := cb.Subscribe(1)
+
+	failN(cb, 1)
+	change := <-events
+	assert.Equal(t, StateOpen, change.To)
+
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+	unsubscribe()
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(0, time.Minute, WithName("rating"), WithClock(c))
+	assert.Equal(t, Snapshot{Name: "rating", State: StateClosed}, cb.Snapshot())
+
+	failN(cb, 1)
+	assert.Equal(t, Snapshot{
+		Name:            "rating",
+		State:           StateOpen,
+		Counts:          Counts{Calls: 1, Failures: 1},
+		LastFailureTime: c.Now(),
+		NextProbeTime:   c.Now().Add(time.Minute),
+	}, cb.Snapshot())
+}
+
+func TestForceOpenHoldsUntilReset(t *testing.T) {
+	c := newFakeClock()
+	cb := NewCircuitBreaker(3, 30*time.Second, WithClock(c))
+
+	cb.ForceOpen()
+	c.Advance(time.Hour)
+	assert.Equal(t, StateOpen, cb.GetState())
+	assert.True(t, cb.Snapshot().Forced)
+	assert.True(t, cb.Snapshot().NextProbeTime.IsZero())
+	assert.ErrorIs(t, cb.Execute(func() error { return nil }, nil), ErrOpenState)
+
+	cb.Reset()
+	assert.Equal(t, StateClosed, cb.GetState())
+	assert.NoError(t, cb.Execute(func() error { return nil }, nil))
+}
+
+func TestForceCloseIgnoresFailures(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	failN(cb, 1)
+
+	cb.ForceClose()
+	failN(cb, 5)
+	assert.Equal(t, StateClosed, cb.GetState())
+	assert.Equal(t, 5, cb.Snapshot().Counts.Failures)
+
+	cb.Reset()
+	assert.Equal(t, Counts{}, cb.Counts())
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
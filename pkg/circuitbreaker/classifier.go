@@ -0,0 +1,41 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// FailureClassifier reports whether err, returned by a guarded call, means
+// the dependency is unhealthy.
+type FailureClassifier func(err error) bool
+
+// HTTPStatusError is returned by guarded HTTP calls that got an unexpected
+// status. Body holds the upstream reply so it can be relayed to the client.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("status %d", e.StatusCode)
+}
+
+// IsAnyError treats every non-nil error as a failure.
+func IsAnyError(err error) bool {
+	return err != nil
+}
+
+// IsServerFailure counts transport errors, timeouts and 5xx responses as
+// failures. Other HTTP statuses, and calls the caller cancelled, are the
+// caller's problem, not the dependency's.
+func IsServerFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return err != nil
+}
@@ -0,0 +1,110 @@
+package circuitbreaker
+
+import "time"
+
+// Transition reasons reported in StateChange.Reason.
+const (
+	ReasonFailureThreshold = "failure threshold exceeded"
+	ReasonFailureRate      = "failure rate exceeded"
+	ReasonSlowCallRate     = "slow call rate exceeded"
+	ReasonProbeFailed      = "half-open probe failed"
+	ReasonProbeSlow        = "half-open probe was slow"
+	ReasonProbesSucceeded  = "half-open probes succeeded"
+	ReasonOpenTimeout      = "open timeout elapsed"
+)
+
+// StateChange describes a single breaker transition. Counts are the window
+// statistics at the moment of the transition, before they are reset.
+type StateChange struct {
+	Name   string
+	From   State
+	To     State
+	Reason string
+	Counts Counts
+	At     time.Time
+}
+
+// Listener is called after every state transition, outside the breaker's
+// lock. Listeners may be called concurrently and must not block for long.
+type Listener func(StateChange)
+
+// WithName sets the name reported in StateChange events.
+func WithName(name string) Option {
+	return func(cb *CircuitBreaker) {
+		cb.name = name
+	}
+}
+
+// Name returns the name set with WithName.
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// OnStateChange registers l for all future transitions and returns a
+// function that unregisters it.
+func (cb *CircuitBreaker) OnStateChange(l Listener) func() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	id := cb.nextListenerID
+	cb.nextListenerID++
+	if cb.listeners == nil {
+		cb.listeners = make(map[int]Listener)
+	}
+	cb.listeners[id] = l
+
+	return func() {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		delete(cb.listeners, id)
+	}
+}
+
+// Subscribe returns a channel receiving transitions as they happen and a
+// function that unsubscribes and closes it. Events are dropped rather than
+// delivered late when the consumer lets more than buffer of them pile up.
+func (cb *CircuitBreaker) Subscribe(buffer int) (<-chan StateChange, func()) {
+	events := make(chan StateChange, buffer)
+	var done bool
+	unregister := cb.OnStateChange(func(change StateChange) {
+		cb.subscribersMu.RLock()
+		defer cb.subscribersMu.RUnlock()
+		if done {
+			return
+		}
+		select {
+		case events <- change:
+		default:
+		}
+	})
+	return events, func() {
+		unregister()
+		cb.subscribersMu.Lock()
+		defer cb.subscribersMu.Unlock()
+		if !done {
+			done = true
+			close(events)
+		}
+	}
+}
+
+// unlock releases cb.mu and then delivers the transitions recorded while it
+// was held, so listeners are free to call back into the breaker.
+func (cb *CircuitBreaker) unlock() {
+	pending := cb.pending
+	cb.pending = nil
+	var listeners []Listener
+	if len(pending) > 0 {
+		listeners = make([]Listener, 0, len(cb.listeners))
+		for _, l := range cb.listeners {
+			listeners = append(listeners, l)
+		}
+	}
+	cb.mu.Unlock()
+
+	for _, change := range pending {
+		for _, l := range listeners {
+			l(change)
+		}
+	}
+}
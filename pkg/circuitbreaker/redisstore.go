@@ -0,0 +1,88 @@
+package circuitbreaker
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultStorePrefix = "circuit_breaker"
+
+// RedisStore is a Store keeping each breaker in a hash (<prefix>:<name>)
+// and its recent failures in a sorted set (<prefix>:<name>:failures).
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisStore(redisClient *redis.Client, prefix string) *RedisStore {
+	if redisClient == nil {
+		panic("redis client cannot be nil")
+	}
+	if prefix == "" {
+		prefix = defaultStorePrefix
+	}
+	return &RedisStore{
+		client: redisClient,
+		prefix: prefix,
+	}
+}
+
+func (s *RedisStore) stateKey(name string) string {
+	return s.prefix + ":" + name
+}
+
+func (s *RedisStore) failuresKey(name string) string {
+	return s.prefix + ":" + name + ":failures"
+}
+
+func (s *RedisStore) Load(ctx context.Context, name string) (SharedState, error) {
+	fields, err := s.client.HGetAll(ctx, s.stateKey(name)).Result()
+	if err != nil {
+		return SharedState{}, err
+	}
+	if len(fields) == 0 {
+		return SharedState{State: StateClosed}, nil
+	}
+
+	state, _ := strconv.Atoi(fields["state"])
+	openUntil, _ := strconv.ParseInt(fields["open_until"], 10, 64)
+	updatedAt, _ := strconv.ParseInt(fields["updated_at"], 10, 64)
+	return SharedState{
+		State:     State(state),
+		OpenUntil: time.UnixMilli(openUntil),
+		UpdatedAt: time.UnixMilli(updatedAt),
+	}, nil
+}
+
+func (s *RedisStore) Save(ctx context.Context, name string, state SharedState) error {
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, s.stateKey(name),
+		"state", int(state.State),
+		"open_until", state.OpenUntil.UnixMilli(),
+		"updated_at", state.UpdatedAt.UnixMilli(),
+	)
+	if state.State == StateClosed {
+		pipe.Del(ctx, s.failuresKey(name))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) AddFailure(ctx context.Context, name string, at time.Time, window time.Duration) (int, error) {
+	key := s.failuresKey(name)
+	cutoff := at.Add(-window).UnixMilli()
+
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(at.UnixMilli()), Member: uuid.New().String()})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(cutoff, 10))
+	count := pipe.ZCard(ctx, key)
+	pipe.PExpire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
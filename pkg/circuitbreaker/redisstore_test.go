@@ -0,0 +1,74 @@
+package circuitbreaker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStore(client, "test_cb"), server
+}
+
+func TestSharedStoreCountsFailuresAcrossReplicas(t *testing.T) {
+	store, _ := newTestStore(t)
+	a := NewCircuitBreaker(2, time.Minute, WithName("rating"), WithStore(store, 0))
+	b := NewCircuitBreaker(2, time.Minute, WithName("rating"), WithStore(store, 0))
+
+	failN(a, 2)
+	assert.Equal(t, StateClosed, a.GetState())
+
+	failN(b, 1)
+	assert.Equal(t, StateOpen, b.GetState())
+
+	// a learns about the open breaker on its next call.
+	err := a.Execute(func() error { return nil }, nil)
+	assert.ErrorIs(t, err, ErrOpenState)
+	assert.Equal(t, StateOpen, a.GetState())
+}
+
+func TestSharedStorePropagatesClose(t *testing.T) {
+	store, _ := newTestStore(t)
+	c := newFakeClock()
+	a := NewCircuitBreaker(0, 10*time.Second, WithName("library"), WithStore(store, 0), WithClock(c))
+	b := NewCircuitBreaker(0, time.Minute, WithName("library"), WithStore(store, 0), WithClock(c))
+
+	failN(a, 1)
+	succeedN(b, 1)
+	assert.Equal(t, StateOpen, b.GetState())
+
+	c.Advance(10 * time.Second)
+	succeedN(a, 1)
+	assert.Equal(t, StateClosed, a.GetState())
+
+	succeedN(b, 1)
+	assert.Equal(t, StateClosed, b.GetState())
+}
+
+func TestSharedStoreUnavailableFallsBackToLocalState(t *testing.T) {
+	store, server := newTestStore(t)
+	server.Close()
+	cb := NewCircuitBreaker(1, time.Minute, WithName("reservation"), WithStore(store, 0))
+
+	succeedN(cb, 1)
+	failN(cb, 1)
+	assert.Equal(t, StateClosed, cb.GetState())
+	failN(cb, 1)
+	assert.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestRedisStoreLoadEmpty(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	shared, err := store.Load(context.Background(), "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, StateClosed, shared.State)
+	assert.True(t, shared.UpdatedAt.IsZero())
+}
@@ -0,0 +1,116 @@
+package circuitbreaker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Settings describe how a Registry builds a breaker. Zero fields of a
+// per-key override fall back to the registry defaults; override Options are
+// applied after the default ones, so they win where both set the same thing.
+type Settings struct {
+	MaxFailures int
+	Timeout     time.Duration
+	Window      time.Duration
+	Options     []Option
+}
+
+// Registry hands out one breaker per key, creating it on first use. Each
+// breaker is named after its key.
+type Registry struct {
+	mu        sync.Mutex
+	defaults  Settings
+	overrides map[string]Settings
+	breakers  map[string]*CircuitBreaker
+	listeners []Listener
+}
+
+// NewRegistry creates an empty registry. A zero Window in defaults means a
+// 60 second window, as with NewCircuitBreaker.
+func NewRegistry(defaults Settings) *Registry {
+	if defaults.Window == 0 {
+		defaults.Window = 60 * time.Second
+	}
+	return &Registry{
+		defaults:  defaults,
+		overrides: make(map[string]Settings),
+		breakers:  make(map[string]*CircuitBreaker),
+	}
+}
+
+// Override sets the settings used for key. It only affects a breaker that
+// has not been created yet.
+func (r *Registry) Override(key string, settings Settings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.overrides[key] = settings
+}
+
+// OnStateChange registers l with every breaker of the registry, including
+// the ones created later.
+func (r *Registry) OnStateChange(l Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, l)
+	for _, cb := range r.breakers {
+		cb.OnStateChange(l)
+	}
+}
+
+// Get returns the breaker for key, creating it if needed.
+func (r *Registry) Get(key string) *CircuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cb, ok := r.breakers[key]; ok {
+		return cb
+	}
+
+	settings := r.settings(key)
+	opts := append([]Option{WithName(key)}, settings.Options...)
+	cb := NewCircuitBreakerWithWindow(settings.MaxFailures, settings.Timeout, settings.Window, opts...)
+	for _, l := range r.listeners {
+		cb.OnStateChange(l)
+	}
+	r.breakers[key] = cb
+	return cb
+}
+
+// Lookup returns the breaker for key without creating it.
+func (r *Registry) Lookup(key string) (*CircuitBreaker, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cb, ok := r.breakers[key]
+	return cb, ok
+}
+
+// Breakers returns the breakers created so far, ordered by name.
+func (r *Registry) Breakers() []*CircuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breakers := make([]*CircuitBreaker, 0, len(r.breakers))
+	for _, cb := range r.breakers {
+		breakers = append(breakers, cb)
+	}
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].Name() < breakers[j].Name() })
+	return breakers
+}
+
+func (r *Registry) settings(key string) Settings {
+	settings := r.defaults
+	override, ok := r.overrides[key]
+	if !ok {
+		return settings
+	}
+	if override.MaxFailures != 0 {
+		settings.MaxFailures = override.MaxFailures
+	}
+	if override.Timeout != 0 {
+		settings.Timeout = override.Timeout
+	}
+	if override.Window != 0 {
+		settings.Window = override.Window
+	}
+	settings.Options = append(append([]Option{}, r.defaults.Options...), override.Options...)
+	return settings
+}
@@ -0,0 +1,56 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryCreatesOneBreakerPerKey(t *testing.T) {
+	r := NewRegistry(Settings{MaxFailures: 1, Timeout: time.Minute})
+
+	books := r.Get("library GET /books")
+	assert.Same(t, books, r.Get("library GET /books"))
+	assert.Equal(t, "library GET /books", books.Name())
+
+	failN(books, 2)
+	assert.Equal(t, StateOpen, books.GetState())
+	assert.Equal(t, StateClosed, r.Get("library GET /libraries").GetState())
+
+	_, ok := r.Lookup("rating GET /rating")
+	assert.False(t, ok)
+
+	names := []string{}
+	for _, cb := range r.Breakers() {
+		names = append(names, cb.Name())
+	}
+	assert.Equal(t, []string{"library GET /books", "library GET /libraries"}, names)
+}
+
+func TestRegistryOverrides(t *testing.T) {
+	r := NewRegistry(Settings{MaxFailures: 1, Timeout: time.Minute})
+	r.Override("slow", Settings{MaxFailures: 3})
+
+	failN(r.Get("slow"), 2)
+	assert.Equal(t, StateClosed, r.Get("slow").GetState())
+	failN(r.Get("slow"), 2)
+	assert.Equal(t, StateOpen, r.Get("slow").GetState())
+
+	failN(r.Get("fast"), 2)
+	assert.Equal(t, StateOpen, r.Get("fast").GetState())
+}
+
+func TestRegistryListenerSeesLaterBreakers(t *testing.T) {
+	r := NewRegistry(Settings{MaxFailures: 0, Timeout: time.Minute})
+	early := r.Get("early")
+
+	var opened []string
+	r.OnStateChange(func(change StateChange) {
+		opened = append(opened, change.Name)
+	})
+
+	failN(early, 1)
+	failN(r.Get("late"), 1)
+	assert.Equal(t, []string{"early", "late"}, opened)
+}
@@ -0,0 +1,76 @@
+package circuitbreaker
+
+import "time"
+
+// Transition reasons for manual overrides.
+const (
+	ReasonForcedOpen   = "forced open"
+	ReasonForcedClosed = "forced closed"
+	ReasonReset        = "reset"
+)
+
+// Snapshot is a read-only view of a breaker for monitoring. NextProbeTime
+// is when an open breaker admits its next half-open probe; it is zero in
+// any other state and while the breaker is forced open.
+type Snapshot struct {
+	Name            string
+	State           State
+	Forced          bool
+	Counts          Counts
+	LastFailureTime time.Time
+	NextProbeTime   time.Time
+}
+
+func (cb *CircuitBreaker) Snapshot() Snapshot {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	now := cb.clock.Now()
+	snapshot := Snapshot{
+		Name:            cb.name,
+		State:           cb.currentState(now),
+		Forced:          cb.forced,
+		Counts:          cb.stats.counts(now).export(),
+		LastFailureTime: cb.lastFailureTime,
+	}
+	if snapshot.State == StateOpen && !cb.forced {
+		snapshot.NextProbeTime = cb.openUntil
+	}
+	return snapshot
+}
+
+// ForceOpen opens the breaker and keeps it open, rejecting every call,
+// until ForceClose or Reset is called.
+func (cb *CircuitBreaker) ForceOpen() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	now := cb.clock.Now()
+	cb.forced = true
+	cb.openUntil = now.Add(cb.timeout)
+	cb.setState(StateOpen, now, ReasonForcedOpen)
+}
+
+// ForceClose closes the breaker and keeps it closed, letting every call
+// through whatever its outcome, until ForceOpen or Reset is called.
+func (cb *CircuitBreaker) ForceClose() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	cb.forced = true
+	cb.setState(StateClosed, cb.clock.Now(), ReasonForcedClosed)
+}
+
+// Reset returns the breaker to normal operation in the closed state with
+// empty statistics and the initial open timeout.
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	cb.forced = false
+	cb.openTimeout = 0
+	cb.lastFailureTime = time.Time{}
+	cb.failures = cb.failures[:0]
+	cb.stats.reset()
+	cb.setState(StateClosed, cb.clock.Now(), ReasonReset)
+}
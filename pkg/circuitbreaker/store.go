@@ -0,0 +1,122 @@
+package circuitbreaker
+
+import (
+	"context"
+	"time"
+)
+
+// ReasonRemote is reported for transitions adopted from a shared Store.
+const ReasonRemote = "changed by another replica"
+
+// storeTimeout bounds every Store call so an unreachable store costs at
+// most this much latency before the breaker falls back to local state.
+const storeTimeout = 100 * time.Millisecond
+
+// SharedState is the breaker state as last published to a Store.
+// UpdatedAt is zero when nothing has been published yet.
+type SharedState struct {
+	State     State
+	OpenUntil time.Time
+	UpdatedAt time.Time
+}
+
+// Store shares breaker state and failure counts between processes that
+// guard the same dependency under the same breaker name.
+type Store interface {
+	// Load returns the last published state of the named breaker.
+	Load(ctx context.Context, name string) (SharedState, error)
+	// Save publishes a transition of the named breaker.
+	Save(ctx context.Context, name string, state SharedState) error
+	// AddFailure records a failure at at and returns the number of
+	// failures recorded by all processes during the last window.
+	AddFailure(ctx context.Context, name string, at time.Time, window time.Duration) (int, error)
+}
+
+// WithStore shares the breaker's state through store. The shared state is
+// read at most once per syncInterval; in count mode failures are counted
+// across all processes. Store errors are ignored and the breaker keeps
+// working on its local state. The breaker must also be given a name.
+func WithStore(store Store, syncInterval time.Duration) Option {
+	return func(cb *CircuitBreaker) {
+		cb.store = store
+		cb.storeSyncInterval = syncInterval
+	}
+}
+
+func storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), storeTimeout)
+}
+
+// pullState adopts a newer transition published by another process. Only
+// one caller syncs at a time; the others go on with the local state.
+func (cb *CircuitBreaker) pullState() {
+	if cb.store == nil || !cb.syncing.CompareAndSwap(false, true) {
+		return
+	}
+	defer cb.syncing.Store(false)
+
+	cb.mu.RLock()
+	due := cb.clock.Since(cb.lastSync) >= cb.storeSyncInterval
+	cb.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+	shared, err := cb.store.Load(ctx, cb.name)
+
+	cb.mu.Lock()
+	defer cb.unlock()
+	now := cb.clock.Now()
+	cb.lastSync = now
+	if err != nil || cb.forced || !shared.UpdatedAt.After(cb.stateChangedAt) {
+		return
+	}
+
+	switch {
+	case shared.State == StateOpen && now.Before(shared.OpenUntil):
+		cb.openUntil = shared.OpenUntil
+		cb.setState(StateOpen, now, ReasonRemote)
+	case shared.State == StateClosed:
+		cb.setState(StateClosed, now, ReasonRemote)
+	}
+}
+
+// shareFailure adds a local failure to the shared count and trips the
+// breaker when the processes together went over maxFailures.
+func (cb *CircuitBreaker) shareFailure(generation uint64) {
+	if cb.store == nil || cb.rateMode {
+		return
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+	failures, err := cb.store.AddFailure(ctx, cb.name, cb.clock.Now(), cb.window)
+	if err != nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.unlock()
+	now := cb.clock.Now()
+	if generation == cb.generation && !cb.forced && cb.currentState(now) == StateClosed && failures > cb.maxFailures {
+		cb.trip(StateClosed, now, ReasonFailureThreshold)
+	}
+}
+
+// pushState publishes local transitions. It is registered as a listener,
+// so it runs outside the breaker lock.
+func (cb *CircuitBreaker) pushState(change StateChange) {
+	if change.Reason == ReasonRemote || change.To == StateHalfOpen {
+		return
+	}
+
+	cb.mu.RLock()
+	shared := SharedState{State: change.To, OpenUntil: cb.openUntil, UpdatedAt: change.At}
+	cb.mu.RUnlock()
+
+	ctx, cancel := storeContext()
+	defer cancel()
+	cb.store.Save(ctx, cb.name, shared)
+}
@@ -0,0 +1,157 @@
+package circuitbreaker
+
+import "time"
+
+// Window describes the sliding window call statistics are aggregated over,
+// either the last N calls (CountWindow) or the calls of the last period
+// (TimeWindow).
+type Window struct {
+	size    int
+	length  time.Duration
+	buckets int
+}
+
+// CountWindow aggregates the outcomes of the last size calls.
+func CountWindow(size int) Window {
+	if size < 1 {
+		size = 1
+	}
+	return Window{size: size}
+}
+
+// TimeWindow aggregates the outcomes of calls made during the last length,
+// split into buckets that expire one at a time.
+func TimeWindow(length time.Duration, buckets int) Window {
+	if buckets < 1 {
+		buckets = 1
+	}
+	if length < time.Duration(buckets) {
+		length = time.Duration(buckets)
+	}
+	return Window{length: length, buckets: buckets}
+}
+
+func (w Window) newSlidingWindow() slidingWindow {
+	if w.length > 0 {
+		return &timeWindow{
+			bucketLength: w.length / time.Duration(w.buckets),
+			buckets:      make([]bucket, w.buckets),
+		}
+	}
+	return &countWindow{outcomes: make([]outcome, w.size)}
+}
+
+type outcome struct {
+	failed bool
+	slow   bool
+}
+
+type windowCounts struct {
+	calls     int
+	failures  int
+	slowCalls int
+}
+
+func (c *windowCounts) add(o outcome, delta int) {
+	c.calls += delta
+	if o.failed {
+		c.failures += delta
+	}
+	if o.slow {
+		c.slowCalls += delta
+	}
+}
+
+func (c windowCounts) export() Counts {
+	return Counts{Calls: c.calls, Failures: c.failures, SlowCalls: c.slowCalls}
+}
+
+func (c windowCounts) failureRate() float64 {
+	return percent(c.failures, c.calls)
+}
+
+func (c windowCounts) slowCallRate() float64 {
+	return percent(c.slowCalls, c.calls)
+}
+
+func percent(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+type slidingWindow interface {
+	record(now time.Time, o outcome)
+	counts(now time.Time) windowCounts
+	reset()
+}
+
+// countWindow is a ring buffer of the last len(outcomes) call results.
+type countWindow struct {
+	outcomes []outcome
+	next     int
+	total    windowCounts
+}
+
+func (w *countWindow) record(_ time.Time, o outcome) {
+	if w.total.calls == len(w.outcomes) {
+		w.total.add(w.outcomes[w.next], -1)
+	}
+	w.outcomes[w.next] = o
+	w.total.add(o, 1)
+	w.next = (w.next + 1) % len(w.outcomes)
+}
+
+func (w *countWindow) counts(time.Time) windowCounts {
+	return w.total
+}
+
+func (w *countWindow) reset() {
+	w.next = 0
+	w.total = windowCounts{}
+}
+
+type bucket struct {
+	epoch  int64
+	counts windowCounts
+}
+
+// timeWindow keeps one bucket per bucketLength slice of time. A bucket whose
+// epoch is too old is treated as empty and reused.
+type timeWindow struct {
+	bucketLength time.Duration
+	buckets      []bucket
+}
+
+func (w *timeWindow) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(w.bucketLength)
+}
+
+func (w *timeWindow) record(now time.Time, o outcome) {
+	epoch := w.epoch(now)
+	b := &w.buckets[epoch%int64(len(w.buckets))]
+	if b.epoch != epoch {
+		*b = bucket{epoch: epoch}
+	}
+	b.counts.add(o, 1)
+}
+
+func (w *timeWindow) counts(now time.Time) windowCounts {
+	oldest := w.epoch(now) - int64(len(w.buckets)) + 1
+	var total windowCounts
+	for _, b := range w.buckets {
+		if b.epoch >= oldest {
+			total.calls += b.counts.calls
+			total.failures += b.counts.failures
+			total.slowCalls += b.counts.slowCalls
+		}
+	}
+	return total
+}
+
+func (w *timeWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = bucket{}
+	}
+}
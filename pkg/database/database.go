@@ -22,7 +22,7 @@ func InitRatingDB() *gorm.DB {
 		host, user, password, dbname, port)
 
 	log.Printf("Connecting to rating database: host=%s, port=%s", host, port)
-	return initDB(dsn, &models.Rating{})
+	return initDB(dsn, &models.Rating{}, &models.IdempotencyKey{})
 }
 
 func InitLibraryDB() *gorm.DB {
@@ -36,7 +36,7 @@ func InitLibraryDB() *gorm.DB {
 		host, user, password, dbname, port)
 
 	log.Printf("Connecting to library database: host=%s, port=%s", host, port)
-	db := initDB(dsn, &models.Library{}, &models.Book{}, &models.LibraryBook{})
+	db := initDB(dsn, &models.Library{}, &models.Book{}, &models.LibraryBook{}, &models.IdempotencyKey{})
 
 	return db
 }
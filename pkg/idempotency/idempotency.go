@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Header carries the key identifying a request across its retries.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses that were stored for an earlier
+// request with the same key.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// Retention is how long a key is kept. The gateway gives up retrying after
+// a day, so a week covers every automatic retry; a dead letter requeued by
+// hand after that is applied again.
+const Retention = 7 * 24 * time.Hour
+
+// PruneInterval is how often RunPruner deletes expired keys.
+const PruneInterval = time.Hour
+
+// ErrKeyUsed is returned by Save when a concurrent request with the same key
+// was applied first.
+var ErrKeyUsed = errors.New("idempotency key already used")
+
+// Replay answers c with the response stored for its key and reports whether
+// it did. Requests without a key, or with a key not seen yet, are left to
+// the handler. A key seen on a different path is rejected.
+func Replay(c *gin.Context, db *gorm.DB) bool {
+	key := c.GetHeader(Header)
+	if key == "" {
+		return false
+	}
+
+	var record models.IdempotencyKey
+	err := db.Where(&models.IdempotencyKey{Key: key}).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up idempotency key"})
+		return true
+	}
+	if record.Path != c.Request.URL.Path {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "idempotency key was used for a different request"})
+		return true
+	}
+	c.Header(ReplayedHeader, "true")
+	c.Data(record.Status, "application/json; charset=utf-8", record.Body)
+	return true
+}
+
+// Save stores the response to c under its key. It must run in tx, the
+// transaction applying the request, so the key is recorded if and only if
+// the request took effect. If it returns ErrKeyUsed the transaction must be
+// rolled back and the request answered with Replay.
+func Save(tx *gorm.DB, c *gin.Context, status int, response interface{}) error {
+	key := c.GetHeader(Header)
+	if key == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.IdempotencyKey{
+		Key:    key,
+		Path:   c.Request.URL.Path,
+		Status: status,
+		Body:   body,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrKeyUsed
+	}
+	return nil
+}
+
+// Prune deletes the keys stored before cutoff and returns how many it
+// deleted.
+func Prune(db *gorm.DB, cutoff time.Time) (int64, error) {
+	result := db.Where("created_at < ?", cutoff).Delete(&models.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
+
+// RunPruner deletes keys older than Retention every PruneInterval until ctx
+// is done.
+func RunPruner(ctx context.Context, db *gorm.DB, c clock.Clock) {
+	ticker := c.NewTicker(PruneInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := Prune(db.WithContext(ctx), c.Now().Add(-Retention)); err != nil {
+			log.Printf("Failed to prune idempotency keys: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired idempotency keys", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package idempotency
+
+import (
+	"RSOI_lab_3/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect test database: %v", err)
+	}
+	db.AutoMigrate(&models.IdempotencyKey{})
+	return db
+}
+
+func newContext(path, key string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", path, nil)
+	if key != "" {
+		c.Request.Header.Set(Header, key)
+	}
+	return c, w
+}
+
+func TestSaveAndReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+
+	c, _ := newContext("/items/1", "")
+	assert.False(t, Replay(c, db), "requests without a key are not replayed")
+	assert.NoError(t, Save(db, c, http.StatusOK, gin.H{"n": 1}))
+
+	c, _ = newContext("/items/1", "k")
+	assert.False(t, Replay(c, db))
+	assert.NoError(t, Save(db, c, http.StatusCreated, gin.H{"n": 1}))
+	assert.ErrorIs(t, Save(db, c, http.StatusCreated, gin.H{"n": 2}), ErrKeyUsed)
+
+	c, w := newContext("/items/1", "k")
+	assert.True(t, Replay(c, db))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"n":1}`, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(ReplayedHeader))
+
+	c, w = newContext("/items/2", "k")
+	assert.True(t, Replay(c, db))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestSaveIsRolledBackWithTransaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+
+	c, _ := newContext("/items/1", "k")
+	db.Transaction(func(tx *gorm.DB) error {
+		assert.NoError(t, Save(tx, c, http.StatusOK, gin.H{}))
+		return gorm.ErrInvalidData
+	})
+	assert.False(t, Replay(c, db), "the request did not take effect")
+}
+
+func TestPruneDeletesExpiredKeys(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Now()
+	db.Create(&models.IdempotencyKey{Key: "old", Path: "/items/1", Status: http.StatusOK, CreatedAt: now.Add(-Retention - time.Minute)})
+	db.Create(&models.IdempotencyKey{Key: "new", Path: "/items/1", Status: http.StatusOK, CreatedAt: now})
+
+	n, err := Prune(db, now.Add(-Retention))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	var keys []string
+	db.Model(&models.IdempotencyKey{}).Pluck("key", &keys)
+	assert.Equal(t, []string{"new"}, keys)
+}
@@ -0,0 +1,198 @@
+package leader
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultTTL is how long a term lasts unless it is renewed. A new leader
+// takes over at most this long after the previous one died.
+const DefaultTTL = 10 * time.Second
+
+// Elector campaigns for a lock in Redis, so that one of the processes
+// sharing key leads at a time. The lock holds "<id>:<token>"; every new
+// term draws the next token from <key>:token, so tokens only grow and
+// identify the term work was done under (a fencing token). Work that must
+// not outlive the term checks, atomically with each change it makes, that
+// the lock still holds Lock's value (see queue.WithFence). The leader
+// renews the lock every third of the TTL. It considers itself the leader
+// only until TTL after its last successful renewal started, so it steps
+// down before the lock expires even if Redis becomes unreachable.
+type Elector struct {
+	client *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+	clock  clock.Clock
+
+	mu    sync.Mutex
+	token int64
+	until time.Time
+}
+
+// Option customises an Elector at construction time.
+type Option func(*Elector)
+
+// WithTTL sets how long a term lasts without renewal.
+func WithTTL(ttl time.Duration) Option {
+	return func(e *Elector) {
+		if ttl > 0 {
+			e.ttl = ttl
+		}
+	}
+}
+
+// WithClock replaces the wall clock used to time terms and renewals.
+func WithClock(c clock.Clock) Option {
+	return func(e *Elector) {
+		if c != nil {
+			e.clock = c
+		}
+	}
+}
+
+// NewElector campaigns as id, which must be unique per process.
+func NewElector(redisClient *redis.Client, key, id string, opts ...Option) *Elector {
+	if id == "" {
+		panic("leader id cannot be empty")
+	}
+	e := &Elector{
+		client: redisClient,
+		key:    key,
+		id:     id,
+		ttl:    DefaultTTL,
+		clock:  clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// campaignScript renews the lock if ARGV[1] holds it and takes it, with
+// the next token, if nobody does. It returns the token of the term, or
+// false if another process leads.
+var campaignScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local holder, token = string.match(current, '^(.*):(%d+)$')
+	if holder ~= ARGV[1] then
+		return false
+	end
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return tonumber(token)
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// resignScript deletes the lock if it still holds ARGV[1].
+var resignScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (e *Elector) tokenKey() string {
+	return e.key + ":token"
+}
+
+func (e *Elector) value(token int64) string {
+	return e.id + ":" + strconv.FormatInt(token, 10)
+}
+
+// Campaign takes or renews the lock once and reports whether this process
+// leads now. If Redis cannot be reached the current term, if any, runs
+// out on its own.
+func (e *Elector) Campaign(ctx context.Context) (bool, error) {
+	start := e.clock.Now()
+	token, err := campaignScript.Run(ctx, e.client, []string{e.key, e.tokenKey()},
+		e.id, e.ttl.Milliseconds()).Int64()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if errors.Is(err, redis.Nil) {
+		e.token, e.until = 0, time.Time{}
+		return false, nil
+	}
+	if err != nil {
+		return e.leading(), err
+	}
+	e.token, e.until = token, start.Add(e.ttl)
+	return true, nil
+}
+
+func (e *Elector) leading() bool {
+	return e.token != 0 && e.clock.Now().Before(e.until)
+}
+
+// Token returns the fencing token of the current term and true while this
+// process leads.
+func (e *Elector) Token() (int64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.leading() {
+		return 0, false
+	}
+	return e.token, true
+}
+
+// Lock returns the key of the lock and the value it holds during the term
+// of token.
+func (e *Elector) Lock(token int64) (key, value string) {
+	return e.key, e.value(token)
+}
+
+// Resign ends the current term so another process can take over at once.
+func (e *Elector) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	token := e.token
+	e.token, e.until = 0, time.Time{}
+	e.mu.Unlock()
+	if token == 0 {
+		return nil
+	}
+	return resignScript.Run(ctx, e.client, []string{e.key}, e.value(token)).Err()
+}
+
+// Run campaigns every third of the TTL until ctx is done, then resigns.
+// Errors are logged once until a campaign succeeds again.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := e.clock.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	wasLeading, failing := false, false
+	for {
+		leading, err := e.Campaign(ctx)
+		if err != nil && !failing && ctx.Err() == nil {
+			log.Printf("Leader election for %s failed: %v", e.key, err)
+		}
+		failing = err != nil
+		if leading != wasLeading {
+			if leading {
+				token, _ := e.Token()
+				log.Printf("Leading %s as %s (term %d)", e.key, e.id, token)
+			} else {
+				log.Printf("No longer leading %s", e.key)
+			}
+			wasLeading = leading
+		}
+
+		select {
+		case <-ctx.Done():
+			resignCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			e.Resign(resignCtx)
+			return
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package leader
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKey = "retry_queue:leader"
+
+func newTestElectors(t *testing.T) (*miniredis.Miniredis, *clock.Fake, *Elector, *Elector) {
+	mr := miniredis.RunT(t)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	a := NewElector(client, testKey, "gateway-a", WithClock(fake))
+	b := NewElector(client, testKey, "gateway-b", WithClock(fake))
+	return mr, fake, a, b
+}
+
+func TestOnlyOneProcessLeads(t *testing.T) {
+	mr, _, a, b := newTestElectors(t)
+	ctx := context.Background()
+
+	leading, err := a.Campaign(ctx)
+	assert.NoError(t, err)
+	assert.True(t, leading)
+	leading, err = b.Campaign(ctx)
+	assert.NoError(t, err)
+	assert.False(t, leading)
+
+	token, ok := a.Token()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), token)
+	key, value := a.Lock(token)
+	assert.Equal(t, testKey, key)
+	assert.Equal(t, "gateway-a:1", value)
+	mr.CheckGet(t, key, value)
+	_, ok = b.Token()
+	assert.False(t, ok)
+}
+
+func TestRenewalKeepsTheTerm(t *testing.T) {
+	mr, fake, a, b := newTestElectors(t)
+	ctx := context.Background()
+
+	a.Campaign(ctx)
+	for i := 0; i < 5; i++ {
+		mr.FastForward(DefaultTTL / 2)
+		fake.Advance(DefaultTTL / 2)
+		leading, err := a.Campaign(ctx)
+		assert.NoError(t, err)
+		assert.True(t, leading)
+	}
+	leading, _ := b.Campaign(ctx)
+	assert.False(t, leading)
+	token, ok := a.Token()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), token)
+}
+
+func TestAnotherProcessTakesOverWhenTheLeaderDies(t *testing.T) {
+	mr, fake, a, b := newTestElectors(t)
+	ctx := context.Background()
+
+	a.Campaign(ctx)
+	mr.FastForward(DefaultTTL)
+	fake.Advance(DefaultTTL)
+
+	_, ok := a.Token()
+	assert.False(t, ok, "the old leader steps down when its term runs out")
+	leading, err := b.Campaign(ctx)
+	assert.NoError(t, err)
+	assert.True(t, leading)
+	token, _ := b.Token()
+	assert.Equal(t, int64(2), token, "every term gets a larger fencing token")
+
+	_, value := a.Lock(1)
+	held, _ := mr.Get(testKey)
+	assert.NotEqual(t, value, held, "the old term's fence no longer holds")
+	leading, _ = a.Campaign(ctx)
+	assert.False(t, leading)
+}
+
+func TestResignHandsOverAtOnce(t *testing.T) {
+	mr, _, a, b := newTestElectors(t)
+	ctx := context.Background()
+
+	a.Campaign(ctx)
+	assert.NoError(t, a.Resign(ctx))
+	_, ok := a.Token()
+	assert.False(t, ok)
+	leading, _ := b.Campaign(ctx)
+	assert.True(t, leading)
+
+	// Resigning a term that already ended leaves the new leader alone.
+	assert.NoError(t, a.Resign(ctx))
+	token, _ := b.Token()
+	key, value := b.Lock(token)
+	mr.CheckGet(t, key, value)
+}
+
+func TestLeaderStepsDownWhenRedisIsUnreachable(t *testing.T) {
+	mr, fake, a, _ := newTestElectors(t)
+	ctx := context.Background()
+
+	a.Campaign(ctx)
+	mr.Close()
+	fake.Advance(DefaultTTL / 3)
+	leading, err := a.Campaign(ctx)
+	assert.Error(t, err)
+	assert.True(t, leading, "the term lasts until its TTL")
+
+	fake.Advance(DefaultTTL)
+	leading, err = a.Campaign(ctx)
+	assert.Error(t, err)
+	assert.False(t, leading)
+	_, ok := a.Token()
+	assert.False(t, ok)
+}
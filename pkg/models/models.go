@@ -56,3 +56,14 @@ type Reservation struct {
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 }
+
+// IdempotencyKey records the response to a request carrying an
+// Idempotency-Key header, so a replayed request gets the same response
+// instead of being applied twice. Keys expire after idempotency.Retention.
+type IdempotencyKey struct {
+	Key       string `gorm:"primaryKey;size:255"`
+	Path      string `gorm:"not null"`
+	Status    int    `gorm:"not null"`
+	Body      []byte
+	CreatedAt time.Time `gorm:"index"`
+}
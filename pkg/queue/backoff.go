@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffPolicy decides how long a failed request waits before its next
+// attempt: Initial after the first failure, multiplied by Multiplier after
+// every further one up to Max, and randomised by up to ±Jitter (a fraction,
+// e.g. 0.2). The request is given up once its next attempt would fall after
+// Deadline; a zero Deadline means no limit.
+type BackoffPolicy struct {
+	Initial    time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+	Deadline   time.Time
+}
+
+// DefaultBackoff is used for the fields left zero in a request's policy.
+var DefaultBackoff = BackoffPolicy{
+	Initial:    10 * time.Second,
+	Multiplier: 2,
+	Max:        10 * time.Minute,
+	Jitter:     0.2,
+}
+
+// Delay returns the wait after the given number of failed attempts.
+func (p BackoffPolicy) Delay(failures int) time.Duration {
+	initial := p.Initial
+	if initial <= 0 {
+		initial = DefaultBackoff.Initial
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultBackoff.Multiplier
+	}
+	maxDelay := p.Max
+	if maxDelay <= 0 {
+		maxDelay = DefaultBackoff.Max
+	}
+
+	delay := float64(initial) * math.Pow(multiplier, float64(max(failures-1, 0)))
+	delay = min(delay, float64(maxDelay))
+	if p.Jitter > 0 && p.Jitter < 1 {
+		delay += (rand.Float64()*2 - 1) * p.Jitter * delay
+	}
+	return time.Duration(delay)
+}
+
+// ScheduleRetry sets RetryAt for the next attempt after a failure at now.
+// The failures are the original call plus RetryCount failed retries.
+// retryAfter, if positive, is the wait the upstream asked for and replaces
+// the policy's delay. It returns false, leaving RetryAt unchanged, when the
+// attempt would fall after the policy's deadline.
+func (r *RetryRequest) ScheduleRetry(now time.Time, retryAfter time.Duration) bool {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = r.Backoff.Delay(r.RetryCount + 1)
+	}
+	next := now.Add(delay)
+	if !r.Backoff.Deadline.IsZero() && next.After(r.Backoff.Deadline) {
+		return false
+	}
+	r.RetryAt = next
+	return true
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelayGrowsUpToMax(t *testing.T) {
+	p := BackoffPolicy{Initial: time.Second, Multiplier: 3, Max: 20 * time.Second}
+
+	assert.Equal(t, time.Second, p.Delay(1))
+	assert.Equal(t, 3*time.Second, p.Delay(2))
+	assert.Equal(t, 9*time.Second, p.Delay(3))
+	assert.Equal(t, 20*time.Second, p.Delay(4))
+	assert.Equal(t, 20*time.Second, p.Delay(10))
+}
+
+func TestBackoffDelayDefaults(t *testing.T) {
+	var p BackoffPolicy
+	assert.Equal(t, DefaultBackoff.Initial, p.Delay(1))
+	assert.Equal(t, DefaultBackoff.Max, p.Delay(100))
+}
+
+func TestBackoffJitterStaysInRange(t *testing.T) {
+	p := BackoffPolicy{Initial: 10 * time.Second, Multiplier: 2, Max: time.Minute, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		assert.GreaterOrEqual(t, d, 16*time.Second)
+		assert.LessOrEqual(t, d, 24*time.Second)
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	req := &RetryRequest{
+		RetryCount: 1,
+		Backoff: BackoffPolicy{
+			Initial:    10 * time.Second,
+			Multiplier: 2,
+			Max:        time.Hour,
+			Deadline:   now.Add(time.Minute),
+		},
+	}
+
+	assert.True(t, req.ScheduleRetry(now, 0))
+	assert.Equal(t, now.Add(20*time.Second), req.RetryAt)
+
+	assert.True(t, req.ScheduleRetry(now, 45*time.Second), "Retry-After replaces the backoff")
+	assert.Equal(t, now.Add(45*time.Second), req.RetryAt)
+
+	assert.False(t, req.ScheduleRetry(now, 2*time.Minute))
+	assert.Equal(t, now.Add(45*time.Second), req.RetryAt)
+
+	req.RetryCount = 3
+	assert.False(t, req.ScheduleRetry(now, 0), "80s is past the deadline")
+}
@@ -0,0 +1,508 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps requests in process memory. It mirrors RedisBackend,
+// including lease checks and groups, but its requests are lost when the
+// process exits and are not shared with other processes, so it is only
+// meant to bridge a Redis outage (see Queue.Migrate) and for tests.
+// Payloads are stored encoded, so callers never share a request with the
+// backend.
+type MemoryBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	// scheduled and waiting are scored by RetryAt (Unix seconds),
+	// processing by lease expiry (Unix ms) and dead by when the request was
+	// given up on.
+	scheduled  map[string]int64
+	waiting    map[string]int64
+	processing map[string]int64
+	dead       map[string]int64
+	// groups lists the members of each group in order; groupOf maps them
+	// back to their group.
+	groups  map[string][]string
+	groupOf map[string]string
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{}
+	b.reset()
+	return b
+}
+
+// deadLetter is a dead-lettered request together with when it was given up on.
+type deadLetter struct {
+	req *RetryRequest
+	at  time.Time
+}
+
+func (b *MemoryBackend) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = make(map[string][]byte)
+	b.scheduled = make(map[string]int64)
+	b.waiting = make(map[string]int64)
+	b.processing = make(map[string]int64)
+	b.dead = make(map[string]int64)
+	b.groups = make(map[string][]string)
+	b.groupOf = make(map[string]string)
+}
+
+// snapshot returns the dead letters, oldest first, and every request that
+// is still to be delivered, claimed ones included. Ungrouped requests come
+// first, ordered by RetryAt, then the members of each group in order, so
+// that adding the dead letters and then the requests to another backend
+// rebuilds the groups.
+func (b *MemoryBackend) snapshot() ([]*RetryRequest, []deadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var dead []deadLetter
+	for _, id := range sortedIDs(b.dead, nil) {
+		req, err := b.load(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		dead = append(dead, deadLetter{req: req, at: time.Unix(b.dead[id], 0)})
+	}
+
+	var ids []string
+	for _, id := range append(sortedIDs(b.scheduled, nil), sortedIDs(b.processing, nil)...) {
+		if _, ok := b.groupOf[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	pending, err := b.loadAll(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].RetryAt.Before(pending[j].RetryAt)
+	})
+
+	names := make([]string, 0, len(b.groups))
+	for name := range b.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ids = ids[:0]
+		for _, id := range b.groups[name] {
+			if _, ok := b.dead[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		members, err := b.loadAll(ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, members...)
+	}
+	return pending, dead, nil
+}
+
+// sortedIDs returns the IDs in set ordered by score, then ID, like a Redis
+// sorted set. If upTo is not nil only IDs scored at most *upTo are returned.
+func sortedIDs(set map[string]int64, upTo *int64) []string {
+	ids := make([]string, 0, len(set))
+	for id, score := range set {
+		if upTo == nil || score <= *upTo {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if set[ids[i]] != set[ids[j]] {
+			return set[ids[i]] < set[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// due returns the IDs scheduled at or before now, earliest first.
+func (b *MemoryBackend) due(now time.Time) []string {
+	limit := now.Unix()
+	return sortedIDs(b.scheduled, &limit)
+}
+
+// join appends id to the end of group, unless it is a member already.
+func (b *MemoryBackend) join(id, group string) {
+	if _, ok := b.groupOf[id]; group == "" || ok {
+		return
+	}
+	b.groupOf[id] = group
+	b.groups[group] = append(b.groups[group], id)
+}
+
+// schedule makes id due at score, or parks it in the waiting set while an
+// earlier request of its group has not finished.
+func (b *MemoryBackend) schedule(id string, score int64) {
+	if group, ok := b.groupOf[id]; ok && b.groups[group][0] != id {
+		b.waiting[id] = score
+		return
+	}
+	b.scheduled[id] = score
+}
+
+// finish takes id out of its group and schedules the next request in it.
+func (b *MemoryBackend) finish(id string) {
+	group, ok := b.groupOf[id]
+	if !ok {
+		return
+	}
+	delete(b.groupOf, id)
+	members := b.groups[group]
+	for i, member := range members {
+		if member == id {
+			members = append(members[:i:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(b.groups, group)
+		return
+	}
+	b.groups[group] = members
+	if score, ok := b.waiting[members[0]]; ok {
+		delete(b.waiting, members[0])
+		b.scheduled[members[0]] = score
+	}
+}
+
+func (b *MemoryBackend) Enqueue(ctx context.Context, req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data[req.ID] = data
+	b.join(req.ID, req.Group)
+	b.schedule(req.ID, req.RetryAt.Unix())
+	return nil
+}
+
+func (b *MemoryBackend) Dequeue(ctx context.Context, now time.Time) (*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, id := range b.due(now) {
+		delete(b.scheduled, id)
+		b.finish(id)
+		data, ok := b.data[id]
+		if !ok {
+			continue
+		}
+		delete(b.data, id)
+		return decode(data)
+	}
+	return nil, nil
+}
+
+func (b *MemoryBackend) Claim(ctx context.Context, now, leaseExpiry time.Time) (*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	expired := now.UnixMilli()
+	for _, id := range sortedIDs(b.processing, &expired) {
+		delete(b.processing, id)
+		b.schedule(id, now.Unix())
+	}
+
+	leaseUntil := leaseExpiry.UnixMilli()
+	for _, id := range b.due(now) {
+		delete(b.scheduled, id)
+		data, ok := b.data[id]
+		if !ok {
+			b.finish(id)
+			continue
+		}
+		req, err := decode(data)
+		if err != nil {
+			// A payload that cannot be decoded would come back forever.
+			delete(b.data, id)
+			b.finish(id)
+			return nil, err
+		}
+		b.processing[id] = leaseUntil
+		req.leaseUntil = leaseUntil
+		return req, nil
+	}
+	return nil, nil
+}
+
+// release ends the claim on req if it is still held under the lease req
+// was returned with.
+func (b *MemoryBackend) release(req *RetryRequest) bool {
+	lease, ok := b.processing[req.ID]
+	if !ok || lease != req.leaseUntil {
+		return false
+	}
+	delete(b.processing, req.ID)
+	return true
+}
+
+func (b *MemoryBackend) Ack(ctx context.Context, req *RetryRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.release(req) {
+		return ErrLeaseLost
+	}
+	delete(b.data, req.ID)
+	b.finish(req.ID)
+	return nil
+}
+
+func (b *MemoryBackend) Nack(ctx context.Context, req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.release(req) {
+		return ErrLeaseLost
+	}
+	b.data[req.ID] = data
+	b.schedule(req.ID, req.RetryAt.Unix())
+	return nil
+}
+
+// DeadLetter keeps req at the head of its group, holding back the rest of
+// the group.
+func (b *MemoryBackend) DeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.release(req) {
+		return ErrLeaseLost
+	}
+	b.data[req.ID] = data
+	b.dead[req.ID] = at.Unix()
+	return nil
+}
+
+func (b *MemoryBackend) AddDeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data[req.ID] = data
+	b.join(req.ID, req.Group)
+	b.dead[req.ID] = at.Unix()
+	return nil
+}
+
+func (b *MemoryBackend) GetDeadLetters(ctx context.Context) ([]*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loadAll(sortedIDs(b.dead, nil))
+}
+
+func (b *MemoryBackend) GetDeadLetter(ctx context.Context, id string) (*RetryRequest, error) {
+	return b.get(b.dead, id)
+}
+
+// get returns the request with the given ID if it is in set.
+func (b *MemoryBackend) get(set map[string]int64, id string) (*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := set[id]; !ok {
+		return nil, ErrNotFound
+	}
+	return b.load(id)
+}
+
+// find returns the first of sets holding id.
+func find(sets []map[string]int64, id string) (map[string]int64, bool) {
+	for _, set := range sets {
+		if _, ok := set[id]; ok {
+			return set, true
+		}
+	}
+	return nil, false
+}
+
+// move takes the request with the given ID out of whichever of from holds
+// it, lets update change it and schedules it for the time update returns.
+func (b *MemoryBackend) move(id string, update func(*RetryRequest) time.Time, from ...map[string]int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	set, ok := find(from, id)
+	if !ok {
+		return ErrNotFound
+	}
+	req, err := b.load(id)
+	if err != nil {
+		return err
+	}
+	score := update(req)
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	delete(set, id)
+	b.data[id] = data
+	b.schedule(id, score.Unix())
+	return nil
+}
+
+func (b *MemoryBackend) Requeue(ctx context.Context, id string, retryAt time.Time) error {
+	return b.move(id, func(req *RetryRequest) time.Time {
+		req.RetryCount = 0
+		req.RetryAt = retryAt
+		return retryAt
+	}, b.dead)
+}
+
+// remove takes the request with the given ID out of whichever of from holds
+// it and deletes it, letting the next request of its group become due.
+func (b *MemoryBackend) remove(id string, from ...map[string]int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	set, ok := find(from, id)
+	if !ok {
+		return ErrNotFound
+	}
+	delete(set, id)
+	delete(b.data, id)
+	b.finish(id)
+	return nil
+}
+
+func (b *MemoryBackend) Discard(ctx context.Context, id string) error {
+	return b.remove(id, b.dead)
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, id string) (*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, scheduled := b.scheduled[id]
+	_, waiting := b.waiting[id]
+	if !scheduled && !waiting {
+		return nil, ErrNotFound
+	}
+	req, err := b.load(id)
+	if err != nil {
+		return nil, err
+	}
+	req.waiting = waiting
+	return req, nil
+}
+
+func (b *MemoryBackend) Remove(ctx context.Context, id string) error {
+	return b.remove(id, b.scheduled, b.waiting)
+}
+
+func (b *MemoryBackend) Reschedule(ctx context.Context, id string, retryAt time.Time) error {
+	return b.move(id, func(req *RetryRequest) time.Time {
+		req.RetryAt = retryAt
+		return retryAt
+	}, b.scheduled, b.waiting)
+}
+
+func (b *MemoryBackend) Peek(ctx context.Context, now time.Time) (*RetryRequest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := b.due(now)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	req, err := b.load(ids[0])
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return req, err
+}
+
+func (b *MemoryBackend) Size(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.scheduled) + len(b.waiting), nil
+}
+
+func (b *MemoryBackend) GetAll(ctx context.Context) ([]*RetryRequest, error) {
+	return b.List(ctx, 0, -1)
+}
+
+func (b *MemoryBackend) List(ctx context.Context, offset, count int) ([]*RetryRequest, error) {
+	if offset < 0 {
+		return nil, ErrNegativeOffset
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := append(sortedIDs(b.scheduled, nil), sortedIDs(b.waiting, nil)...)
+	ids = ids[min(offset, len(ids)):]
+	if count >= 0 {
+		ids = ids[:min(count, len(ids))]
+	}
+	reqs, err := b.loadAll(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range reqs {
+		_, req.waiting = b.waiting[req.ID]
+	}
+	return reqs, nil
+}
+
+// load and loadAll must be called with b.mu held.
+func (b *MemoryBackend) load(id string) (*RetryRequest, error) {
+	data, ok := b.data[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return decode(data)
+}
+
+// loadAll returns the payloads of ids in order, skipping IDs without one.
+func (b *MemoryBackend) loadAll(ids []string) ([]*RetryRequest, error) {
+	result := make([]*RetryRequest, 0, len(ids))
+	for _, id := range ids {
+		req, err := b.load(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, req)
+	}
+	return result, nil
+}
+
+func decode(data []byte) (*RetryRequest, error) {
+	var req RetryRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
@@ -1,9 +1,10 @@
 package queue
 
 import (
+	"RSOI_lab_3/pkg/clock"
 	"context"
-	"encoding/json"
-	"strconv"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -18,175 +19,359 @@ type RetryRequest struct {
 	RetryAt    time.Time
 	RetryCount int
 	MaxRetries int
+	// Breaker names the circuit breaker guarding the target endpoint.
+	Breaker string
+	// Backoff spaces the attempts; see ScheduleRetry. MaxRetries, if
+	// positive, additionally caps the number of attempts.
+	Backoff BackoffPolicy
+	// LastError and LastStatus describe the last failed attempt; LastStatus
+	// is zero if no response was received.
+	LastError  string
+	LastStatus int
+	// EnqueuedAt is when the request was first queued.
+	EnqueuedAt time.Time
+	// Group, if set, orders the request after the earlier requests of the
+	// same group: it only becomes due once they have been acknowledged,
+	// dequeued or discarded. A dead-lettered request holds its group back
+	// until it is requeued and succeeds, or is discarded.
+	Group string
+
+	// leaseUntil identifies the claim the request was returned by; Ack and
+	// Nack only succeed while that claim is still held.
+	leaseUntil int64
+	// waiting is set by Get and List; see Waiting.
+	waiting bool
+}
+
+// Waiting reports whether the request, as returned by Get or List, waits
+// for an earlier request of its group before it can become due.
+func (r *RetryRequest) Waiting() bool {
+	return r.waiting
+}
+
+// Backend stores the requests of a Queue. The Queue supplies the current
+// time, so backends never read a clock themselves. Backends are
+// implemented in this package: RedisBackend, StreamBackend and MemoryBackend.
+type Backend interface {
+	Enqueue(ctx context.Context, req *RetryRequest) error
+	Dequeue(ctx context.Context, now time.Time) (*RetryRequest, error)
+	Claim(ctx context.Context, now, leaseExpiry time.Time) (*RetryRequest, error)
+	Ack(ctx context.Context, req *RetryRequest) error
+	Nack(ctx context.Context, req *RetryRequest) error
+	DeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error
+	// AddDeadLetter stores req as dead-lettered without it being claimed.
+	AddDeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error
+	Peek(ctx context.Context, now time.Time) (*RetryRequest, error)
+	Size(ctx context.Context) (int, error)
+	GetAll(ctx context.Context) ([]*RetryRequest, error)
+	// List returns count scheduled requests, or all if count is negative,
+	// skipping the first offset: the due or not yet due ones in RetryAt
+	// order, then those waiting for their group in RetryAt order. A negative
+	// offset fails with ErrNegativeOffset.
+	List(ctx context.Context, offset, count int) ([]*RetryRequest, error)
+	Get(ctx context.Context, id string) (*RetryRequest, error)
+	Remove(ctx context.Context, id string) error
+	Reschedule(ctx context.Context, id string, retryAt time.Time) error
+	GetDeadLetters(ctx context.Context) ([]*RetryRequest, error)
+	GetDeadLetter(ctx context.Context, id string) (*RetryRequest, error)
+	Requeue(ctx context.Context, id string, retryAt time.Time) error
+	Discard(ctx context.Context, id string) error
 }
 
 type Queue struct {
-	client *redis.Client
-	ctx    context.Context
-	key    string
+	mu      sync.RWMutex
+	backend Backend
+	clock   clock.Clock
+	spool   *Spool
 }
 
-const (
-	defaultQueueKey = "retry_queue"
-)
+// Option customises a Queue at construction time.
+type Option func(*Queue)
 
-func NewQueue(redisClient *redis.Client) *Queue {
-	if redisClient == nil {
-		panic("redis client cannot be nil")
-	}
-	return &Queue{
-		client: redisClient,
-		ctx:    context.Background(),
-		key:    defaultQueueKey,
+// WithClock replaces the wall clock used to decide which requests are due.
+func WithClock(c clock.Clock) Option {
+	return func(q *Queue) {
+		if c != nil {
+			q.clock = c
+		}
 	}
 }
 
-func NewQueueWithKey(redisClient *redis.Client, key string) *Queue {
-	if redisClient == nil {
-		panic("redis client cannot be nil")
-	}
-	if key == "" {
-		key = defaultQueueKey
-	}
-	return &Queue{
-		client: redisClient,
-		ctx:    context.Background(),
-		key:    key,
+// WithSpool makes Enqueue fall back to spool when the backend fails, so
+// requests are kept on disk until FlushSpool moves them to the backend.
+func WithSpool(s *Spool) Option {
+	return func(q *Queue) {
+		q.spool = s
 	}
 }
 
-func (q *Queue) Enqueue(req *RetryRequest) error {
-	data, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
+// ErrNotFound is returned when a request does not exist or has left the
+// state the operation expects, e.g. it was claimed.
+var ErrNotFound = errors.New("retry request not found")
 
-	score := float64(req.RetryAt.Unix())
+// ErrLeaseLost is returned by Ack and Nack when the claim expired and the
+// request was handed to another worker or acknowledged already.
+var ErrLeaseLost = errors.New("retry request lease lost")
 
-	member := req.ID
+// ErrNegativeOffset is returned by List for an offset below zero.
+var ErrNegativeOffset = errors.New("retry queue offset cannot be negative")
 
-	err = q.client.ZAdd(q.ctx, q.key, redis.Z{
-		Score:  score,
-		Member: member,
-	}).Err()
-	if err != nil {
-		return err
-	}
+// ErrFenced is returned for operations run under a fence (see WithFence)
+// that no longer holds.
+var ErrFenced = errors.New("retry queue fence lost")
 
-	hashKey := q.key + ":data:" + req.ID
-	err = q.client.Set(q.ctx, hashKey, data, 0).Err()
-	if err != nil {
-		q.client.ZRem(q.ctx, q.key, member)
-		return err
-	}
+// Fence makes changes to a shared queue conditional on the Redis key Key
+// holding Value, e.g. a leader lock holding the term of its holder.
+type Fence struct {
+	Key   string
+	Value string
+}
 
-	return nil
+type fenceContextKey struct{}
+
+// WithFence returns a context under which RedisBackend and StreamBackend
+// only change the queue while fence holds; otherwise operations fail with
+// ErrFenced. The fence is checked by the same script that makes the
+// change, so a process that lost the fence, however long it stalled,
+// cannot change the queue any more. MemoryBackend, which is never shared,
+// ignores fences.
+func WithFence(ctx context.Context, fence Fence) context.Context {
+	return context.WithValue(ctx, fenceContextKey{}, fence)
 }
 
-func (q *Queue) Dequeue() *RetryRequest {
-	now := time.Now()
-	nowUnix := float64(now.Unix())
+func fenceFrom(ctx context.Context) (Fence, bool) {
+	fence, ok := ctx.Value(fenceContextKey{}).(Fence)
+	return fence, ok
+}
 
-	members, err := q.client.ZRangeByScore(q.ctx, q.key, &redis.ZRangeBy{
-		Min:   "-inf",
-		Max:   strconv.FormatFloat(nowUnix, 'f', -1, 64),
-		Count: 1,
-	}).Result()
-	if err != nil {
-		return nil
+func NewQueue(redisClient *redis.Client, opts ...Option) *Queue {
+	return NewQueueWithKey(redisClient, defaultQueueKey, opts...)
+}
+
+func NewQueueWithKey(redisClient *redis.Client, key string, opts ...Option) *Queue {
+	return NewQueueWithBackend(NewRedisBackend(redisClient, key), opts...)
+}
+
+func NewQueueWithBackend(backend Backend, opts ...Option) *Queue {
+	if backend == nil {
+		panic("queue backend cannot be nil")
 	}
+	q := &Queue{
+		backend: backend,
+		clock:   clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
 
-	if len(members) == 0 {
-		return nil
+// Backend returns the backend the queue currently uses.
+func (q *Queue) Backend() Backend {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend
+}
+
+// Migrate moves every request held in memory to backend and switches the
+// queue over to it; other operations wait until it is done. Requests that
+// are claimed at the time are scheduled again in backend, so they may be
+// delivered twice. If copying fails the queue keeps its current backend;
+// requests already copied are overwritten by the next attempt. Migrating
+// away from a backend other than MemoryBackend only switches over, as such
+// a backend keeps its requests.
+func (q *Queue) Migrate(ctx context.Context, backend Backend) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if from, ok := q.backend.(*MemoryBackend); ok {
+		pending, dead, err := from.snapshot()
+		if err != nil {
+			return err
+		}
+		// Dead letters go first, as they hold back the rest of their group.
+		for _, d := range dead {
+			if err := backend.AddDeadLetter(ctx, d.req, d.at); err != nil {
+				return err
+			}
+		}
+		for _, req := range pending {
+			if err := backend.Enqueue(ctx, req); err != nil {
+				return err
+			}
+		}
+		from.reset()
 	}
+	q.backend = backend
+	return nil
+}
 
-	member := members[0]
+// Enqueue schedules req for RetryAt. It sets EnqueuedAt unless it is set.
+// With a spool, requests the backend fails to take within a short timeout
+// are spooled instead, as are all requests while the spool is not empty;
+// Enqueue then only fails if the spool cannot be written either.
+func (q *Queue) Enqueue(ctx context.Context, req *RetryRequest) error {
+	if req.EnqueuedAt.IsZero() {
+		req.EnqueuedAt = q.clock.Now()
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.spool == nil {
+		return q.backend.Enqueue(ctx, req)
+	}
+	return q.spool.enqueue(ctx, req, q.backend.Enqueue)
+}
 
-	hashKey := q.key + ":data:" + member
-	data, err := q.client.Get(q.ctx, hashKey).Result()
-	if err != nil {
-		q.client.ZRem(q.ctx, q.key, member)
-		return nil
+// FlushSpool moves the spooled requests to the backend in RetryAt order,
+// keeping each group in the order it was enqueued, and returns how many it
+// moved. It stops at the first error; the remaining requests stay spooled.
+func (q *Queue) FlushSpool(ctx context.Context) (int, error) {
+	if q.spool == nil {
+		return 0, nil
 	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.spool.flush(func(req *RetryRequest) error {
+		return q.backend.Enqueue(ctx, req)
+	})
+}
 
-	var req RetryRequest
-	err = json.Unmarshal([]byte(data), &req)
-	if err != nil {
-		q.client.ZRem(q.ctx, q.key, member)
-		q.client.Del(q.ctx, hashKey)
-		return nil
+// Spooled returns the number of requests waiting in the spool.
+func (q *Queue) Spooled() int {
+	if q.spool == nil {
+		return 0
 	}
+	return q.spool.Len()
+}
 
-	q.client.ZRem(q.ctx, q.key, member)
-	q.client.Del(q.ctx, hashKey)
+// Dequeue removes and returns the earliest request that is due, or nil if
+// none is. Each request is handed to exactly one caller, across processes.
+// A payload that cannot be decoded is dropped and reported as an error.
+func (q *Queue) Dequeue(ctx context.Context) (*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Dequeue(ctx, q.clock.Now())
+}
 
-	return &req
+// Claim hands out the earliest due request for at most visibility. Unless
+// it is acknowledged (Ack) or put back (Nack) in time, the request becomes
+// due again and may be claimed by another worker, so every request is
+// delivered at least once even if a worker dies while processing it. Claim
+// returns nil and no error when nothing is due.
+func (q *Queue) Claim(ctx context.Context, visibility time.Duration) (*RetryRequest, error) {
+	now := q.clock.Now()
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Claim(ctx, now, now.Add(visibility))
 }
 
-func (q *Queue) Peek() *RetryRequest {
-	now := time.Now()
-	nowUnix := float64(now.Unix())
+// Ack removes a request returned by Claim once it has been processed.
+func (q *Queue) Ack(ctx context.Context, req *RetryRequest) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Ack(ctx, req)
+}
 
-	members, err := q.client.ZRangeByScore(q.ctx, q.key, &redis.ZRangeBy{
-		Min:   "-inf",
-		Max:   strconv.FormatFloat(nowUnix, 'f', -1, 64),
-		Count: 1,
-	}).Result()
-	if err != nil {
-		return nil
-	}
+// Nack returns a request obtained from Claim to the queue, saving any
+// changes made to it; it becomes due again at req.RetryAt.
+func (q *Queue) Nack(ctx context.Context, req *RetryRequest) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Nack(ctx, req)
+}
 
-	if len(members) == 0 {
-		return nil
-	}
+// DeadLetter gives up on a request obtained from Claim. It is kept, with
+// its last error, until it is requeued or discarded.
+func (q *Queue) DeadLetter(ctx context.Context, req *RetryRequest) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.DeadLetter(ctx, req, q.clock.Now())
+}
 
-	member := members[0]
+// GetDeadLetters returns the dead-lettered requests, oldest first.
+func (q *Queue) GetDeadLetters(ctx context.Context) ([]*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.GetDeadLetters(ctx)
+}
 
-	hashKey := q.key + ":data:" + member
-	data, err := q.client.Get(q.ctx, hashKey).Result()
-	if err != nil {
-		return nil
-	}
+// GetDeadLetter returns the dead-lettered request with the given ID.
+func (q *Queue) GetDeadLetter(ctx context.Context, id string) (*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.GetDeadLetter(ctx, id)
+}
 
-	var req RetryRequest
-	err = json.Unmarshal([]byte(data), &req)
-	if err != nil {
-		return nil
-	}
+// Requeue gives a dead-lettered request a fresh set of attempts, the first
+// one at retryAt.
+func (q *Queue) Requeue(ctx context.Context, id string, retryAt time.Time) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Requeue(ctx, id, retryAt)
+}
 
-	return &req
+// Discard deletes a dead-lettered request for good.
+func (q *Queue) Discard(ctx context.Context, id string) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Discard(ctx, id)
 }
 
-func (q *Queue) Size() int {
-	count, err := q.client.ZCard(q.ctx, q.key).Result()
-	if err != nil {
-		return 0
-	}
-	return int(count)
+// Peek returns the earliest due request without removing it, or nil if
+// none is due.
+func (q *Queue) Peek(ctx context.Context) (*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Peek(ctx, q.clock.Now())
 }
 
-func (q *Queue) GetAll() []*RetryRequest {
-	members, err := q.client.ZRange(q.ctx, q.key, 0, -1).Result()
-	if err != nil {
-		return []*RetryRequest{}
-	}
+// Size returns the number of scheduled requests, due or not, including
+// requests waiting for an earlier request of their group. Claimed and
+// dead-lettered requests are not counted.
+func (q *Queue) Size(ctx context.Context) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Size(ctx)
+}
 
-	result := make([]*RetryRequest, 0, len(members))
-	for _, member := range members {
-		hashKey := q.key + ":data:" + member
-		data, err := q.client.Get(q.ctx, hashKey).Result()
-		if err != nil {
-			continue
-		}
+// GetAll returns the scheduled requests in the order of List.
+func (q *Queue) GetAll(ctx context.Context) ([]*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.GetAll(ctx)
+}
 
-		var req RetryRequest
-		err = json.Unmarshal([]byte(data), &req)
-		if err != nil {
-			continue
-		}
+// List returns up to count scheduled requests, skipping the first offset.
+// Requests waiting for an earlier request of their group come after the
+// others; each part is ordered by RetryAt.
+func (q *Queue) List(ctx context.Context, offset, count int) ([]*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.List(ctx, offset, count)
+}
 
-		result = append(result, &req)
-	}
+// Get returns the scheduled request with the given ID, including one
+// waiting for its group. Requests that are claimed or dead-lettered are not
+// found.
+func (q *Queue) Get(ctx context.Context, id string) (*RetryRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Get(ctx, id)
+}
+
+// Remove deletes a scheduled request without delivering it. Removing a
+// request waiting for its group leaves the rest of the group in order.
+func (q *Queue) Remove(ctx context.Context, id string) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Remove(ctx, id)
+}
 
-	return result
+// Reschedule moves the next attempt of a scheduled request to retryAt,
+// keeping its retry count. A request waiting for its group still waits
+// for the earlier requests.
+func (q *Queue) Reschedule(ctx context.Context, id string, retryAt time.Time) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.backend.Reschedule(ctx, id, retryAt)
 }
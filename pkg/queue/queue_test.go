@@ -0,0 +1,630 @@
+package queue
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueue(t *testing.T, c clock.Clock) (*Queue, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewQueue(client, WithClock(c)), mr
+}
+
+// forEachBackend runs test against a queue on each backend, driven by a
+// fake clock.
+func forEachBackend(t *testing.T, test func(t *testing.T, q *Queue, fake *clock.Fake)) {
+	t.Run("redis", func(t *testing.T) {
+		fake := newFakeClock()
+		q, _ := newTestQueue(t, fake)
+		test(t, q, fake)
+	})
+	t.Run("stream", func(t *testing.T) {
+		fake := newFakeClock()
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		test(t, NewQueueWithBackend(NewStreamBackend(client, "", "worker-1"), WithClock(fake)), fake)
+	})
+	t.Run("memory", func(t *testing.T) {
+		fake := newFakeClock()
+		test(t, NewQueueWithBackend(NewMemoryBackend(), WithClock(fake)), fake)
+	})
+}
+
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+}
+
+func size(t *testing.T, q *Queue) int {
+	n, err := q.Size(context.Background())
+	assert.NoError(t, err)
+	return n
+}
+
+func claim(t *testing.T, q *Queue) *RetryRequest {
+	req, err := q.Claim(context.Background(), 30*time.Second)
+	assert.NoError(t, err)
+	return req
+}
+
+func TestEnqueueDequeueRespectsRetryAt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+
+		assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "later", RetryAt: fake.Now().Add(time.Minute)}))
+		assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "now", Method: "POST", RetryAt: fake.Now()}))
+		assert.Equal(t, 2, size(t, q))
+
+		peeked, err := q.Peek(ctx)
+		assert.NoError(t, err)
+		if assert.NotNil(t, peeked) {
+			assert.Equal(t, "now", peeked.ID)
+		}
+
+		req, err := q.Dequeue(ctx)
+		assert.NoError(t, err)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "now", req.ID)
+			assert.Equal(t, "POST", req.Method)
+		}
+		req, err = q.Dequeue(ctx)
+		assert.NoError(t, err)
+		assert.Nil(t, req)
+
+		fake.Advance(time.Minute)
+		req, err = q.Dequeue(ctx)
+		assert.NoError(t, err)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "later", req.ID)
+		}
+		assert.Equal(t, 0, size(t, q))
+	})
+}
+
+func TestDequeueSkipsMissingPayload(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	mr := miniredis.RunT(t)
+	backend := NewRedisBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	q := NewQueueWithBackend(backend, WithClock(fake))
+
+	q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now().Add(-time.Second)})
+	q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now()})
+	mr.Del(backend.dataKey("a"))
+
+	req, err := q.Dequeue(ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, req) {
+		assert.Equal(t, "b", req.ID)
+	}
+	assert.Equal(t, 0, size(t, q))
+}
+
+func TestQueueReportsRedisErrors(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	q := NewQueue(redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}))
+	mr.Close()
+
+	assert.Error(t, q.Enqueue(ctx, &RetryRequest{ID: "a"}))
+	_, err := q.Dequeue(ctx)
+	assert.Error(t, err)
+	_, err = q.Claim(ctx, time.Second)
+	assert.Error(t, err)
+	_, err = q.Peek(ctx)
+	assert.Error(t, err)
+	_, err = q.Size(ctx)
+	assert.Error(t, err)
+	_, err = q.GetAll(ctx)
+	assert.Error(t, err)
+}
+
+func TestDequeueDeliversEachRequestOnce(t *testing.T) {
+	const (
+		requests = 200
+		workers  = 8
+	)
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	producer := NewQueue(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	for i := 0; i < requests; i++ {
+		producer.Enqueue(ctx, &RetryRequest{ID: fmt.Sprint(i), RetryAt: time.Now().Add(-time.Minute)})
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every worker has its own connection, like separate replicas.
+			consumer := NewQueue(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+			for {
+				req, err := consumer.Dequeue(ctx)
+				if err != nil || req == nil {
+					return
+				}
+				mu.Lock()
+				delivered[req.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, delivered, requests)
+	for id, n := range delivered {
+		assert.Equal(t, 1, n, "request %s", id)
+	}
+	assert.Equal(t, 0, size(t, producer))
+}
+
+func TestClaimedRequestReappearsAfterVisibilityTimeout(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+
+		first := claim(t, q)
+		if !assert.NotNil(t, first) {
+			return
+		}
+		assert.Nil(t, claim(t, q))
+
+		fake.Advance(31 * time.Second)
+		second := claim(t, q)
+		if assert.NotNil(t, second) {
+			assert.Equal(t, "a", second.ID)
+		}
+
+		assert.ErrorIs(t, q.Ack(ctx, first), ErrLeaseLost)
+		assert.NoError(t, q.Ack(ctx, second))
+		assert.ErrorIs(t, q.Ack(ctx, second), ErrLeaseLost)
+
+		fake.Advance(time.Minute)
+		assert.Nil(t, claim(t, q))
+		assert.Equal(t, 0, size(t, q))
+	})
+}
+
+func TestNackSchedulesUpdatedRequest(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+
+		req := claim(t, q)
+		if !assert.NotNil(t, req) {
+			return
+		}
+		req.RetryCount++
+		req.RetryAt = fake.Now().Add(10 * time.Second)
+		assert.NoError(t, q.Nack(ctx, req))
+		assert.ErrorIs(t, q.Nack(ctx, req), ErrLeaseLost)
+		assert.Nil(t, claim(t, q))
+
+		fake.Advance(10 * time.Second)
+		req = claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, 1, req.RetryCount)
+		}
+	})
+}
+
+func TestDeadLetterRequeueAndDiscard(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now()})
+
+		for i := 0; i < 2; i++ {
+			req := claim(t, q)
+			if !assert.NotNil(t, req) {
+				return
+			}
+			req.RetryCount = 5
+			req.LastError = "status 500"
+			req.LastStatus = 500
+			assert.NoError(t, q.DeadLetter(ctx, req))
+		}
+		assert.Equal(t, 0, size(t, q))
+
+		fake.Advance(time.Minute)
+		assert.Nil(t, claim(t, q), "dead letters are not retried")
+		dead, err := q.GetDeadLetters(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, dead, 2)
+
+		req, err := q.GetDeadLetter(ctx, "a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "status 500", req.LastError)
+			assert.Equal(t, 500, req.LastStatus)
+		}
+		_, err = q.GetDeadLetter(ctx, "missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		assert.NoError(t, q.Requeue(ctx, "a", fake.Now()))
+		assert.ErrorIs(t, q.Requeue(ctx, "a", fake.Now()), ErrNotFound)
+		req = claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "a", req.ID)
+			assert.Equal(t, 0, req.RetryCount)
+		}
+
+		assert.NoError(t, q.Discard(ctx, "b"))
+		assert.ErrorIs(t, q.Discard(ctx, "b"), ErrNotFound)
+		dead, err = q.GetDeadLetters(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, dead)
+	})
+}
+
+func TestMemoryClaimDeliversEachRequestOnce(t *testing.T) {
+	const (
+		requests = 200
+		workers  = 8
+	)
+	ctx := context.Background()
+	q := NewQueueWithBackend(NewMemoryBackend())
+	for i := 0; i < requests; i++ {
+		q.Enqueue(ctx, &RetryRequest{ID: fmt.Sprint(i), RetryAt: time.Now().Add(-time.Minute)})
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				req, err := q.Claim(ctx, time.Minute)
+				if err != nil || req == nil {
+					return
+				}
+				mu.Lock()
+				delivered[req.ID]++
+				mu.Unlock()
+				assert.NoError(t, q.Ack(ctx, req))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, delivered, requests)
+	for id, n := range delivered {
+		assert.Equal(t, 1, n, "request %s", id)
+	}
+	assert.Equal(t, 0, size(t, q))
+}
+
+func TestMigrateMovesRequestsToRedis(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	memory := NewMemoryBackend()
+	q := NewQueueWithBackend(memory, WithClock(fake))
+
+	q.Enqueue(ctx, &RetryRequest{ID: "dead", RetryAt: fake.Now()})
+	dead := claim(t, q)
+	if !assert.NotNil(t, dead) {
+		return
+	}
+	dead.LastError = "status 500"
+	assert.NoError(t, q.DeadLetter(ctx, dead))
+	q.Enqueue(ctx, &RetryRequest{ID: "claimed", RetryAt: fake.Now()})
+	assert.NotNil(t, claim(t, q))
+	q.Enqueue(ctx, &RetryRequest{ID: "later", RetryAt: fake.Now().Add(time.Minute)})
+
+	mr := miniredis.RunT(t)
+	redisBackend := NewRedisBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")
+	assert.NoError(t, q.Migrate(ctx, redisBackend))
+	assert.Same(t, Backend(redisBackend), q.Backend())
+
+	all, err := q.GetAll(ctx)
+	assert.NoError(t, err)
+	ids := []string{}
+	for _, req := range all {
+		ids = append(ids, req.ID)
+	}
+	assert.Equal(t, []string{"claimed", "later"}, ids, "claimed requests are scheduled again")
+
+	req, err := q.GetDeadLetter(ctx, "dead")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "status 500", req.LastError)
+	}
+
+	n, err := memory.Size(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	left, err := memory.GetDeadLetters(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+}
+
+func TestMigrateKeepsBackendOnError(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemoryBackend()
+	q := NewQueueWithBackend(memory)
+	q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: time.Now()})
+
+	mr := miniredis.RunT(t)
+	unreachable := NewRedisBackend(redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}), "")
+	mr.Close()
+
+	assert.Error(t, q.Migrate(ctx, unreachable))
+	assert.Same(t, Backend(memory), q.Backend())
+	assert.Equal(t, 1, size(t, q))
+}
+
+func TestListGetRemoveAndReschedule(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		for i, id := range []string{"a", "b", "c"} {
+			q.Enqueue(ctx, &RetryRequest{ID: id, RetryAt: fake.Now().Add(time.Duration(i+1) * time.Minute)})
+		}
+
+		page, err := q.List(ctx, 1, 5)
+		assert.NoError(t, err)
+		if assert.Len(t, page, 2) {
+			assert.Equal(t, "b", page[0].ID)
+			assert.Equal(t, "c", page[1].ID)
+			assert.Equal(t, fake.Now(), page[0].EnqueuedAt.UTC())
+		}
+		page, err = q.List(ctx, 3, 5)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+		page, err = q.List(ctx, math.MaxInt-1, 5)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+		_, err = q.List(ctx, -1, 5)
+		assert.ErrorIs(t, err, ErrNegativeOffset)
+
+		req, err := q.Get(ctx, "b")
+		if assert.NoError(t, err) {
+			assert.Equal(t, fake.Now().Add(2*time.Minute), req.RetryAt.UTC())
+		}
+		_, err = q.Get(ctx, "missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		assert.NoError(t, q.Reschedule(ctx, "c", fake.Now()))
+		claimed := claim(t, q)
+		if assert.NotNil(t, claimed) {
+			assert.Equal(t, "c", claimed.ID)
+		}
+		assert.ErrorIs(t, q.Reschedule(ctx, "c", fake.Now()), ErrNotFound, "claimed requests are left alone")
+		assert.ErrorIs(t, q.Remove(ctx, "c"), ErrNotFound)
+
+		assert.NoError(t, q.Remove(ctx, "a"))
+		assert.ErrorIs(t, q.Remove(ctx, "a"), ErrNotFound)
+		assert.Equal(t, 1, size(t, q))
+	})
+}
+
+func TestGroupedRequestsRunInOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", Group: "g", RetryAt: fake.Now().Add(time.Minute)})
+		q.Enqueue(ctx, &RetryRequest{ID: "b", Group: "g", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "c", RetryAt: fake.Now()})
+		assert.Equal(t, 3, size(t, q), "b counts while it waits for a")
+
+		req := claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "c", req.ID)
+			assert.NoError(t, q.Ack(ctx, req))
+		}
+		assert.Nil(t, claim(t, q))
+
+		fake.Advance(time.Minute)
+		req = claim(t, q)
+		if !assert.NotNil(t, req) {
+			return
+		}
+		assert.Equal(t, "a", req.ID)
+		assert.Nil(t, claim(t, q), "b waits while a is claimed")
+		req.RetryAt = fake.Now().Add(10 * time.Second)
+		assert.NoError(t, q.Nack(ctx, req))
+		assert.Nil(t, claim(t, q), "b waits while a is retried")
+
+		fake.Advance(10 * time.Second)
+		req = claim(t, q)
+		if !assert.NotNil(t, req) {
+			return
+		}
+		assert.NoError(t, q.DeadLetter(ctx, req))
+		assert.Nil(t, claim(t, q), "b waits while a is dead-lettered")
+
+		assert.NoError(t, q.Requeue(ctx, "a", fake.Now()))
+		req = claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "a", req.ID)
+			assert.NoError(t, q.Ack(ctx, req))
+		}
+		req = claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "b", req.ID)
+			assert.NoError(t, q.Ack(ctx, req))
+		}
+		assert.Equal(t, 0, size(t, q))
+	})
+}
+
+func TestDiscardingReleasesGroup(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", Group: "g", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "b", Group: "g", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "c", Group: "g", RetryAt: fake.Now()})
+
+		req := claim(t, q)
+		if !assert.NotNil(t, req) {
+			return
+		}
+		assert.NoError(t, q.DeadLetter(ctx, req))
+		assert.NoError(t, q.Discard(ctx, "a"))
+
+		assert.NoError(t, q.Remove(ctx, "b"))
+		req = claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, "c", req.ID)
+		}
+	})
+}
+
+func TestWaitingRequestsCanBeManaged(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, q *Queue, fake *clock.Fake) {
+		ctx := context.Background()
+		q.Enqueue(ctx, &RetryRequest{ID: "a", Group: "g", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "b", Group: "g", RetryAt: fake.Now()})
+		q.Enqueue(ctx, &RetryRequest{ID: "c", Group: "g", RetryAt: fake.Now().Add(time.Minute)})
+		q.Enqueue(ctx, &RetryRequest{ID: "d", RetryAt: fake.Now().Add(time.Hour)})
+
+		all, err := q.GetAll(ctx)
+		assert.NoError(t, err)
+		var ids []string
+		var waiting []bool
+		for _, req := range all {
+			ids = append(ids, req.ID)
+			waiting = append(waiting, req.Waiting())
+		}
+		assert.Equal(t, []string{"a", "d", "b", "c"}, ids)
+		assert.Equal(t, []bool{false, false, true, true}, waiting)
+
+		page, err := q.List(ctx, 1, 2)
+		assert.NoError(t, err)
+		if assert.Len(t, page, 2) {
+			assert.Equal(t, "d", page[0].ID)
+			assert.Equal(t, "b", page[1].ID)
+		}
+		page, err = q.List(ctx, 3, 5)
+		assert.NoError(t, err)
+		if assert.Len(t, page, 1) {
+			assert.Equal(t, "c", page[0].ID)
+		}
+
+		req, err := q.Get(ctx, "c")
+		if assert.NoError(t, err) {
+			assert.True(t, req.Waiting())
+		}
+		req, err = q.Get(ctx, "a")
+		if assert.NoError(t, err) {
+			assert.False(t, req.Waiting())
+		}
+
+		assert.NoError(t, q.Reschedule(ctx, "c", fake.Now()))
+		req, err = q.Get(ctx, "c")
+		if assert.NoError(t, err) {
+			assert.True(t, req.Waiting(), "c still waits for a and b")
+			assert.Equal(t, fake.Now().Unix(), req.RetryAt.Unix())
+		}
+
+		assert.NoError(t, q.Remove(ctx, "b"))
+		assert.ErrorIs(t, q.Remove(ctx, "b"), ErrNotFound)
+		assert.Equal(t, 3, size(t, q))
+
+		for _, want := range []string{"a", "c"} {
+			req := claim(t, q)
+			if assert.NotNil(t, req) {
+				assert.Equal(t, want, req.ID)
+				assert.NoError(t, q.Ack(ctx, req))
+			}
+		}
+		assert.Equal(t, 1, size(t, q))
+	})
+}
+
+func TestMigrateKeepsGroupOrder(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	q := NewQueueWithBackend(NewMemoryBackend(), WithClock(fake))
+	for _, id := range []string{"z", "y", "x"} {
+		q.Enqueue(ctx, &RetryRequest{ID: id, Group: "g", RetryAt: fake.Now()})
+	}
+	req := claim(t, q)
+	if !assert.NotNil(t, req) {
+		return
+	}
+	assert.NoError(t, q.DeadLetter(ctx, req))
+
+	mr := miniredis.RunT(t)
+	assert.NoError(t, q.Migrate(ctx, NewRedisBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "")))
+	assert.Nil(t, claim(t, q), "the dead letter still holds the group back")
+
+	assert.NoError(t, q.Discard(ctx, "z"))
+	for _, want := range []string{"y", "x"} {
+		req := claim(t, q)
+		if assert.NotNil(t, req) {
+			assert.Equal(t, want, req.ID)
+			assert.NoError(t, q.Ack(ctx, req))
+		}
+	}
+}
+
+func TestFencedOperationsStopOnceTheFenceIsLost(t *testing.T) {
+	backends := map[string]func(client *redis.Client) Backend{
+		"redis":  func(client *redis.Client) Backend { return NewRedisBackend(client, "") },
+		"stream": func(client *redis.Client) Backend { return NewStreamBackend(client, "", "worker-1") },
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeClock()
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { client.Close() })
+			q := NewQueueWithBackend(newBackend(client), WithClock(fake))
+			ctx := context.Background()
+			fenced := WithFence(ctx, Fence{Key: "leader", Value: "gateway-a:1"})
+
+			mr.Set("leader", "gateway-a:1")
+			assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()}))
+			assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now()}))
+			req, err := q.Claim(fenced, 30*time.Second)
+			assert.NoError(t, err)
+			if !assert.NotNil(t, req) {
+				return
+			}
+
+			// Another process took over the lock.
+			mr.Set("leader", "gateway-b:2")
+			assert.ErrorIs(t, q.Ack(fenced, req), ErrFenced)
+			assert.ErrorIs(t, q.Nack(fenced, req), ErrFenced)
+			assert.ErrorIs(t, q.DeadLetter(fenced, req), ErrFenced)
+			_, err = q.Claim(fenced, 30*time.Second)
+			assert.ErrorIs(t, err, ErrFenced)
+			assert.Equal(t, 1, size(t, q), "b was not claimed")
+
+			// The request claimed under the lost fence is delivered again.
+			fake.Advance(31 * time.Second)
+			current := WithFence(ctx, Fence{Key: "leader", Value: "gateway-b:2"})
+			var ids []string
+			for i := 0; i < 2; i++ {
+				again, err := q.Claim(current, 30*time.Second)
+				assert.NoError(t, err)
+				if assert.NotNil(t, again) {
+					ids = append(ids, again.ID)
+				}
+			}
+			assert.ElementsMatch(t, []string{"a", "b"}, ids)
+		})
+	}
+}
+
+func TestMemoryBackendIgnoresFences(t *testing.T) {
+	fake := newFakeClock()
+	q := NewQueueWithBackend(NewMemoryBackend(), WithClock(fake))
+	fenced := WithFence(context.Background(), Fence{Key: "leader", Value: "gateway-a:1"})
+	assert.NoError(t, q.Enqueue(fenced, &RetryRequest{ID: "a", RetryAt: fake.Now()}))
+	req, err := q.Claim(fenced, 30*time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, q.Ack(fenced, req))
+}
@@ -0,0 +1,590 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultQueueKey = "retry_queue"
+
+// RedisBackend keeps requests in Redis so they survive restarts and are
+// shared by every process using the same key. Payloads live under
+// <key>:data:<id>; the IDs are kept in sorted sets: <key> by RetryAt,
+// <key>:processing by lease expiry and <key>:dead by when they were given
+// up on. Grouped requests are listed in order under <key>:group:<group>,
+// their groups are kept in the hash <key>:groups, and those waiting for an
+// earlier request of their group are kept in <key>:waiting by RetryAt.
+// Operations touching several keys run as scripts.
+type RedisBackend struct {
+	client *redis.Client
+	key    string
+}
+
+func NewRedisBackend(redisClient *redis.Client, key string) *RedisBackend {
+	if redisClient == nil {
+		panic("redis client cannot be nil")
+	}
+	if key == "" {
+		key = defaultQueueKey
+	}
+	return &RedisBackend{
+		client: redisClient,
+		key:    key,
+	}
+}
+
+func (b *RedisBackend) dataKey(id string) string {
+	return b.key + ":data:" + id
+}
+
+// deadKey holds dead-lettered IDs scored by when they were given up on.
+func (b *RedisBackend) deadKey() string {
+	return b.key + ":dead"
+}
+
+// waitingKey holds the IDs waiting for an earlier request of their group,
+// scored by RetryAt.
+func (b *RedisBackend) waitingKey() string {
+	return b.key + ":waiting"
+}
+
+// newScript returns a script run with the queue key as its only key. The
+// script can use the helpers below, which derive the other keys from it.
+func newScript(src string) *redis.Script {
+	return redis.NewScript(`
+local base = KEYS[1]
+
+-- Under a fence (see WithFence) nothing is changed unless KEYS[2] still
+-- holds the last argument.
+if KEYS[2] and redis.call('GET', KEYS[2]) ~= ARGV[#ARGV] then
+	return redis.error_reply('FENCED retry queue fence lost')
+end
+
+local function dataKey(id)
+	return base .. ':data:' .. id
+end
+
+-- join appends id to the end of its group, unless it is a member already.
+local function join(id, group)
+	if group == '' or redis.call('HGET', base .. ':groups', id) then
+		return
+	end
+	redis.call('HSET', base .. ':groups', id, group)
+	redis.call('RPUSH', base .. ':group:' .. group, id)
+end
+
+-- schedule makes id due at score, or parks it in the waiting set while an
+-- earlier request of its group has not finished.
+local function schedule(id, score)
+	local group = redis.call('HGET', base .. ':groups', id)
+	if group and redis.call('LINDEX', base .. ':group:' .. group, 0) ~= id then
+		redis.call('ZADD', base .. ':waiting', score, id)
+	else
+		redis.call('ZADD', base, score, id)
+	end
+end
+
+-- finish takes id out of its group and schedules the next request in it.
+local function finish(id)
+	local group = redis.call('HGET', base .. ':groups', id)
+	if not group then
+		return
+	end
+	redis.call('HDEL', base .. ':groups', id)
+	local list = base .. ':group:' .. group
+	redis.call('LREM', list, 1, id)
+	local nextId = redis.call('LINDEX', list, 0)
+	if nextId then
+		local score = redis.call('ZSCORE', base .. ':waiting', nextId)
+		if score then
+			redis.call('ZREM', base .. ':waiting', nextId)
+			redis.call('ZADD', base, score, nextId)
+		end
+	end
+end
+
+-- take takes id out of the sorted set named by suffix, a suffix of the
+-- queue key, and reports whether it was there. The empty suffix names the
+-- queue itself, including the requests waiting for their group.
+local function take(suffix, id)
+	local removed = redis.call('ZREM', base .. suffix, id)
+	if suffix == '' then
+		removed = removed + redis.call('ZREM', base .. ':waiting', id)
+	end
+	return removed > 0
+end
+
+-- release ends the claim on id if the caller's lease is still held.
+local function release(id, lease)
+	local held = redis.call('ZSCORE', base .. ':processing', id)
+	if not held or tonumber(held) ~= tonumber(lease) then
+		return false
+	end
+	redis.call('ZREM', base .. ':processing', id)
+	return true
+end
+` + src)
+}
+
+// run runs script with the queue key, adding the fence of ctx, if any.
+func (b *RedisBackend) run(ctx context.Context, script *redis.Script, args ...interface{}) *redis.Cmd {
+	keys := []string{b.key}
+	if fence, ok := fenceFrom(ctx); ok {
+		keys = append(keys, fence.Key)
+		args = append(args, fence.Value)
+	}
+	cmd := script.Run(ctx, b.client, keys, args...)
+	var redisErr redis.Error
+	if errors.As(cmd.Err(), &redisErr) && strings.HasPrefix(redisErr.Error(), "FENCED") {
+		cmd.SetErr(ErrFenced)
+	}
+	return cmd
+}
+
+// enqueueScript stores the payload and schedules it together, so a worker
+// never sees an ID without its payload.
+var enqueueScript = newScript(`
+redis.call('SET', dataKey(ARGV[1]), ARGV[3])
+join(ARGV[1], ARGV[4])
+schedule(ARGV[1], ARGV[2])
+`)
+
+// Enqueue replaces any earlier request with the same ID; it keeps its
+// place in its group.
+func (b *RedisBackend) Enqueue(ctx context.Context, req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = b.run(ctx, enqueueScript, req.ID, req.RetryAt.Unix(), data, req.Group).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+// dequeueScript pops the earliest due ID and its payload. IDs whose payload
+// is missing are dropped. Running it as a script makes the pop atomic, so
+// concurrent workers never receive the same request.
+var dequeueScript = newScript(`
+while true do
+	local ids = redis.call('ZRANGEBYSCORE', base, '-inf', ARGV[1], 'LIMIT', 0, 1)
+	if #ids == 0 then
+		return false
+	end
+	redis.call('ZREM', base, ids[1])
+	finish(ids[1])
+	local data = redis.call('GET', dataKey(ids[1]))
+	if data then
+		redis.call('DEL', dataKey(ids[1]))
+		return data
+	end
+end
+`)
+
+func (b *RedisBackend) Dequeue(ctx context.Context, now time.Time) (*RetryRequest, error) {
+	data, err := b.run(ctx, dequeueScript, now.Unix()).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var req RetryRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// claimScript first returns requests whose lease expired to the queue, then
+// moves the earliest due request to the processing set with a new lease.
+// The payload stays in place until the request is acknowledged.
+var claimScript = newScript(`
+local expired = redis.call('ZRANGEBYSCORE', base .. ':processing', '-inf', ARGV[2])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', base .. ':processing', id)
+	schedule(id, ARGV[1])
+end
+while true do
+	local ids = redis.call('ZRANGEBYSCORE', base, '-inf', ARGV[1], 'LIMIT', 0, 1)
+	if #ids == 0 then
+		return false
+	end
+	redis.call('ZREM', base, ids[1])
+	local data = redis.call('GET', dataKey(ids[1]))
+	if data then
+		redis.call('ZADD', base .. ':processing', ARGV[3], ids[1])
+		return {ids[1], data}
+	end
+	finish(ids[1])
+end
+`)
+
+func (b *RedisBackend) Claim(ctx context.Context, now, leaseExpiry time.Time) (*RetryRequest, error) {
+	leaseUntil := leaseExpiry.UnixMilli()
+	claimed, err := b.run(ctx, claimScript, now.Unix(), now.UnixMilli(), leaseUntil).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var req RetryRequest
+	if err := json.Unmarshal([]byte(claimed[1]), &req); err != nil {
+		// A payload that cannot be decoded would come back forever.
+		b.Ack(ctx, &RetryRequest{ID: claimed[0], leaseUntil: leaseUntil})
+		return nil, err
+	}
+	req.leaseUntil = leaseUntil
+	return &req, nil
+}
+
+// ackScript removes a claimed request if the caller's lease is still held.
+var ackScript = newScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+redis.call('DEL', dataKey(ARGV[1]))
+finish(ARGV[1])
+return 1
+`)
+
+// Ack lets the next request of the request's group become due.
+func (b *RedisBackend) Ack(ctx context.Context, req *RetryRequest) error {
+	ok, err := b.run(ctx, ackScript, req.ID, req.leaseUntil).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// nackScript puts a claimed request back in the queue, saving its updated
+// payload, if the caller's lease is still held.
+var nackScript = newScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+redis.call('SET', dataKey(ARGV[1]), ARGV[4])
+schedule(ARGV[1], ARGV[3])
+return 1
+`)
+
+func (b *RedisBackend) Nack(ctx context.Context, req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := b.run(ctx, nackScript, req.ID, req.leaseUntil, req.RetryAt.Unix(), data).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// deadLetterScript moves a claimed request to the dead letters, saving its
+// updated payload, if the caller's lease is still held. It stays at the
+// head of its group, holding back the rest of the group.
+var deadLetterScript = newScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+redis.call('SET', dataKey(ARGV[1]), ARGV[4])
+redis.call('ZADD', base .. ':dead', ARGV[3], ARGV[1])
+return 1
+`)
+
+func (b *RedisBackend) DeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := b.run(ctx, deadLetterScript, req.ID, req.leaseUntil, at.Unix(), data).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+var addDeadLetterScript = newScript(`
+redis.call('SET', dataKey(ARGV[1]), ARGV[3])
+join(ARGV[1], ARGV[4])
+redis.call('ZADD', base .. ':dead', ARGV[2], ARGV[1])
+`)
+
+func (b *RedisBackend) AddDeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = b.run(ctx, addDeadLetterScript, req.ID, at.Unix(), data, req.Group).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+func (b *RedisBackend) GetDeadLetters(ctx context.Context) ([]*RetryRequest, error) {
+	ids, err := b.client.ZRange(ctx, b.deadKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return b.loadAll(ctx, ids)
+}
+
+func (b *RedisBackend) GetDeadLetter(ctx context.Context, id string) (*RetryRequest, error) {
+	return b.get(ctx, b.deadKey(), id)
+}
+
+// get returns the request with the given ID if it is in the sorted set.
+func (b *RedisBackend) get(ctx context.Context, set, id string) (*RetryRequest, error) {
+	if err := b.client.ZScore(ctx, set, id).Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return b.load(ctx, id)
+}
+
+// moveScript takes a request out of the sorted set named by ARGV[4] (see
+// take) and schedules it, saving its updated payload, unless it left the
+// set in the meantime.
+var moveScript = newScript(`
+if not take(ARGV[4], ARGV[1]) then
+	return 0
+end
+redis.call('SET', dataKey(ARGV[1]), ARGV[3])
+schedule(ARGV[1], ARGV[2])
+return 1
+`)
+
+// move takes the request with the given ID out of the sorted set named by
+// suffix (see take), lets update change it and schedules it for the time
+// update returns.
+func (b *RedisBackend) move(ctx context.Context, suffix, id string, update func(*RetryRequest) time.Time) error {
+	var req *RetryRequest
+	var err error
+	if suffix == "" {
+		req, err = b.Get(ctx, id)
+	} else {
+		req, err = b.get(ctx, b.key+suffix, id)
+	}
+	if err != nil {
+		return err
+	}
+	score := update(req)
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := b.run(ctx, moveScript, id, score.Unix(), data, suffix).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (b *RedisBackend) Requeue(ctx context.Context, id string, retryAt time.Time) error {
+	return b.move(ctx, ":dead", id, func(req *RetryRequest) time.Time {
+		req.RetryCount = 0
+		req.RetryAt = retryAt
+		return retryAt
+	})
+}
+
+// removeScript takes a request out of the sorted set named by ARGV[2] (see
+// take) and deletes it, letting the next request of its group become due.
+var removeScript = newScript(`
+if not take(ARGV[2], ARGV[1]) then
+	return 0
+end
+redis.call('DEL', dataKey(ARGV[1]))
+finish(ARGV[1])
+return 1
+`)
+
+func (b *RedisBackend) remove(ctx context.Context, suffix, id string) error {
+	ok, err := b.run(ctx, removeScript, id, suffix).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (b *RedisBackend) Discard(ctx context.Context, id string) error {
+	return b.remove(ctx, ":dead", id)
+}
+
+// Get looks in the waiting set first: requests only move from there to the
+// queue itself, so one moving in between is still found.
+func (b *RedisBackend) Get(ctx context.Context, id string) (*RetryRequest, error) {
+	req, err := b.get(ctx, b.waitingKey(), id)
+	if err == nil {
+		req.waiting = true
+		return req, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return b.get(ctx, b.key, id)
+}
+
+func (b *RedisBackend) Remove(ctx context.Context, id string) error {
+	return b.remove(ctx, "", id)
+}
+
+func (b *RedisBackend) Reschedule(ctx context.Context, id string, retryAt time.Time) error {
+	return b.move(ctx, "", id, func(req *RetryRequest) time.Time {
+		req.RetryAt = retryAt
+		return retryAt
+	})
+}
+
+func (b *RedisBackend) load(ctx context.Context, id string) (*RetryRequest, error) {
+	data, err := b.client.Get(ctx, b.dataKey(id)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var req RetryRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// loadAll returns the payloads of ids in order, skipping IDs whose payload
+// was removed in the meantime.
+func (b *RedisBackend) loadAll(ctx context.Context, ids []string) ([]*RetryRequest, error) {
+	result := make([]*RetryRequest, 0, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = b.dataKey(id)
+	}
+	values, err := b.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var req RetryRequest
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			return nil, err
+		}
+		result = append(result, &req)
+	}
+	return result, nil
+}
+
+func (b *RedisBackend) Peek(ctx context.Context, now time.Time) (*RetryRequest, error) {
+	ids, err := b.client.ZRangeByScore(ctx, b.key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: 1,
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	req, err := b.load(ctx, ids[0])
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return req, err
+}
+
+func (b *RedisBackend) Size(ctx context.Context) (int, error) {
+	var scheduled, waiting *redis.IntCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		scheduled = pipe.ZCard(ctx, b.key)
+		waiting = pipe.ZCard(ctx, b.waitingKey())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(scheduled.Val() + waiting.Val()), nil
+}
+
+func (b *RedisBackend) GetAll(ctx context.Context) ([]*RetryRequest, error) {
+	return b.List(ctx, 0, -1)
+}
+
+func (b *RedisBackend) List(ctx context.Context, offset, count int) ([]*RetryRequest, error) {
+	if offset < 0 {
+		return nil, ErrNegativeOffset
+	}
+	if count == 0 {
+		return []*RetryRequest{}, nil
+	}
+	stop := int64(-1)
+	if count > 0 && offset <= math.MaxInt-count {
+		// Otherwise the page runs past any queue, up to the end.
+		stop = int64(offset + count - 1)
+	}
+	ids, err := b.client.ZRange(ctx, b.key, int64(offset), stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.loadAll(ctx, ids)
+	if err != nil || (count > 0 && len(ids) >= count) {
+		return result, err
+	}
+
+	// The page runs past the due and not yet due requests into the
+	// waiting ones.
+	scheduled, err := b.client.ZCard(ctx, b.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	start := max(int64(offset)-scheduled, 0)
+	stop = -1
+	if count > 0 {
+		stop = start + int64(count-len(ids)) - 1
+	}
+	ids, err = b.client.ZRange(ctx, b.waitingKey(), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := b.loadAll(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range waiting {
+		req.waiting = true
+	}
+	return append(result, waiting...), nil
+}
@@ -0,0 +1,255 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool keeps requests on disk while the backend of a Queue cannot take
+// them (see WithSpool). Each request is a file <seq>.json in dir, written
+// to a temporary file, synced and renamed, so a crash leaves either the
+// whole request or nothing. seq orders the files by when they were
+// spooled. Files that cannot be decoded are renamed to <seq>.json.corrupt
+// and skipped.
+type Spool struct {
+	dir string
+
+	// flushMu lets one flush run at a time; mu guards the files and the
+	// counters below and is never held while waiting for the backend.
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	seq     uint64
+	pending int
+}
+
+const (
+	spoolExt     = ".json"
+	spoolTmpExt  = ".tmp"
+	spoolCorrupt = ".corrupt"
+)
+
+// directTimeout bounds handing a request to the backend before it is
+// spooled instead, so a backend that hangs does not hold up the caller.
+const directTimeout = 2 * time.Second
+
+// OpenSpool uses dir, creating it if needed, and picks up the requests
+// spooled there before a restart.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, spoolTmpExt) {
+			// Never renamed, so never acknowledged to the caller.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, ok := spoolSeq(name)
+		if !ok {
+			continue
+		}
+		s.seq = max(s.seq, seq)
+		if strings.HasSuffix(name, spoolExt) {
+			s.pending++
+		}
+	}
+	return s, nil
+}
+
+// spoolSeq parses the sequence number of a spool file, corrupt or not.
+func spoolSeq(name string) (uint64, bool) {
+	base, _, _ := strings.Cut(name, ".")
+	seq, err := strconv.ParseUint(base, 10, 64)
+	return seq, err == nil
+}
+
+// Len returns the number of spooled requests.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// enqueue hands req to direct, giving it at most directTimeout, or spools
+// it if direct fails. While older requests are spooled req is spooled
+// behind them without trying direct, so the flush keeps groups in the order
+// they were enqueued. A request enqueued after another one returned thus
+// never overtakes it, even though concurrent requests try direct at once.
+func (s *Spool) enqueue(ctx context.Context, req *RetryRequest, direct func(context.Context, *RetryRequest) error) error {
+	s.mu.Lock()
+	if s.pending > 0 {
+		defer s.mu.Unlock()
+		return s.write(req)
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, directTimeout)
+	err := direct(ctx, req)
+	cancel()
+	if err == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(req)
+}
+
+func (s *Spool) write(req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolExt))
+	tmp := name + spoolTmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type spooled struct {
+	path string
+	seq  uint64
+	req  *RetryRequest
+}
+
+// flush hands the spooled requests to enqueue in RetryAt order and removes
+// each once it was taken. It stops at the first error, leaving the rest
+// spooled, and returns how many requests it moved. Requests spooled while
+// it runs stay behind for the next flush, and until then keep later ones
+// spooled behind them.
+func (s *Spool) flush(enqueue func(*RetryRequest) error) (int, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	if s.pending == 0 {
+		s.mu.Unlock()
+		return 0, nil
+	}
+	entries, err := s.load()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if err := enqueue(entry.req); err != nil {
+			return moved, err
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			// Flushed again next time, which only overwrites it.
+			return moved, err
+		}
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+		moved++
+	}
+	return moved, nil
+}
+
+// load reads the spooled requests in flush order: by RetryAt, with the
+// members of each group kept in the order they were spooled. A group takes
+// the RetryAt positions of its members, so it neither jumps ahead nor falls
+// behind ungrouped requests.
+func (s *Spool) load() ([]spooled, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []spooled
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, ok := spoolSeq(name)
+		if !ok {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var req RetryRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			if err := os.Rename(path, path+spoolCorrupt); err != nil {
+				return nil, err
+			}
+			s.pending--
+			continue
+		}
+		entries = append(entries, spooled{path: path, seq: seq, req: &req})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.req.RetryAt.Equal(b.req.RetryAt) {
+			return a.req.RetryAt.Before(b.req.RetryAt)
+		}
+		return a.seq < b.seq
+	})
+	slots := make(map[string][]int)
+	members := make(map[string][]spooled)
+	for i, entry := range entries {
+		if group := entry.req.Group; group != "" {
+			slots[group] = append(slots[group], i)
+			members[group] = append(members[group], entry)
+		}
+	}
+	for group, positions := range slots {
+		inOrder := members[group]
+		sort.Slice(inOrder, func(i, j int) bool { return inOrder[i].seq < inOrder[j].seq })
+		for k, pos := range positions {
+			entries[pos] = inOrder[k]
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyBackend fails every Enqueue while down and records the IDs it took.
+type flakyBackend struct {
+	Backend
+	down     bool
+	enqueued []string
+}
+
+func (b *flakyBackend) Enqueue(ctx context.Context, req *RetryRequest) error {
+	if b.down {
+		return errors.New("backend down")
+	}
+	b.enqueued = append(b.enqueued, req.ID)
+	return b.Backend.Enqueue(ctx, req)
+}
+
+// hangingBackend blocks Enqueue of the request with ID slow until its
+// context is done, and records the deadline every Enqueue was given.
+type hangingBackend struct {
+	Backend
+	slow    string
+	started chan struct{}
+
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (b *hangingBackend) Enqueue(ctx context.Context, req *RetryRequest) error {
+	deadline, _ := ctx.Deadline()
+	b.mu.Lock()
+	b.deadlines = append(b.deadlines, deadline)
+	b.mu.Unlock()
+	if req.ID == b.slow {
+		close(b.started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.Backend.Enqueue(ctx, req)
+}
+
+func openTestSpool(t *testing.T, dir string) *Spool {
+	spool, err := OpenSpool(dir)
+	assert.NoError(t, err)
+	return spool
+}
+
+func TestSpoolKeepsRequestsWhileRedisIsDown(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	q := NewQueue(client, WithClock(fake), WithSpool(openTestSpool(t, dir)))
+
+	mr.Close()
+	assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()}))
+	assert.Equal(t, 1, q.Spooled())
+
+	// The spool survives a restart of the process.
+	q = NewQueue(client, WithClock(fake), WithSpool(openTestSpool(t, dir)))
+	assert.Equal(t, 1, q.Spooled())
+	_, err := q.FlushSpool(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 1, q.Spooled())
+
+	assert.NoError(t, mr.Restart())
+	// Spooled behind "a" rather than overtaking it.
+	assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now()}))
+	assert.Equal(t, 2, q.Spooled())
+
+	moved, err := q.FlushSpool(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	assert.Equal(t, 0, q.Spooled())
+	assert.Equal(t, 2, size(t, q))
+	assert.Equal(t, "a", claim(t, q).ID)
+
+	assert.NoError(t, q.Enqueue(ctx, &RetryRequest{ID: "c", RetryAt: fake.Now()}))
+	assert.Equal(t, 0, q.Spooled())
+}
+
+func TestFlushSpoolKeepsRetryAtAndGroupOrder(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	backend := &flakyBackend{Backend: NewMemoryBackend(), down: true}
+	q := NewQueueWithBackend(backend, WithClock(fake), WithSpool(openTestSpool(t, t.TempDir())))
+
+	now := fake.Now()
+	for _, req := range []*RetryRequest{
+		{ID: "a", RetryAt: now.Add(30 * time.Second), Group: "r1"},
+		{ID: "b", RetryAt: now.Add(10 * time.Second), Group: "r1"},
+		{ID: "c", RetryAt: now.Add(20 * time.Second)},
+		{ID: "d", RetryAt: now.Add(5 * time.Second)},
+	} {
+		assert.NoError(t, q.Enqueue(ctx, req))
+	}
+	assert.Equal(t, 4, q.Spooled())
+	assert.Empty(t, backend.enqueued)
+
+	backend.down = false
+	moved, err := q.FlushSpool(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, moved)
+	// By RetryAt, except that b waits for a, which was spooled first.
+	assert.Equal(t, []string{"d", "a", "c", "b"}, backend.enqueued)
+}
+
+func TestFlushSpoolStopsAtFirstError(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	dir := t.TempDir()
+	backend := &flakyBackend{Backend: NewMemoryBackend(), down: true}
+	q := NewQueueWithBackend(backend, WithClock(fake), WithSpool(openTestSpool(t, dir)))
+	q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+	q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now().Add(time.Second)})
+
+	moved, err := q.FlushSpool(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 0, moved)
+	assert.Equal(t, 2, q.Spooled())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, files, 2)
+}
+
+func TestOpenSpoolSkipsDamagedFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fake := newFakeClock()
+	backend := &flakyBackend{Backend: NewMemoryBackend(), down: true}
+	q := NewQueueWithBackend(backend, WithClock(fake), WithSpool(openTestSpool(t, dir)))
+	q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+
+	// A write cut short by a crash, and a file that cannot be decoded.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000002.json.tmp"), []byte("{"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000003.json"), []byte("{"), 0o600))
+
+	spool := openTestSpool(t, dir)
+	assert.Equal(t, 2, spool.Len())
+	q = NewQueueWithBackend(backend, WithClock(fake), WithSpool(spool))
+	backend.down = false
+	moved, err := q.FlushSpool(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	assert.Equal(t, 0, q.Spooled())
+	assert.Equal(t, []string{"a"}, backend.enqueued)
+	assert.FileExists(t, filepath.Join(dir, "00000000000000000003.json.corrupt"))
+	assert.NoFileExists(t, filepath.Join(dir, "00000000000000000002.json.tmp"))
+
+	// New files are numbered after every existing one.
+	backend.down = true
+	q.Enqueue(ctx, &RetryRequest{ID: "b", RetryAt: fake.Now()})
+	assert.FileExists(t, filepath.Join(dir, "00000000000000000004.json"))
+}
+
+func TestSpoolDoesNotWaitForHangingEnqueue(t *testing.T) {
+	fake := newFakeClock()
+	backend := &hangingBackend{Backend: NewMemoryBackend(), slow: "a", started: make(chan struct{})}
+	q := NewQueueWithBackend(backend, WithClock(fake), WithSpool(openTestSpool(t, t.TempDir())))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+	}()
+	<-backend.started
+
+	// Other requests are not held up while a is stuck in the backend.
+	before := time.Now()
+	assert.NoError(t, q.Enqueue(context.Background(), &RetryRequest{ID: "b", RetryAt: fake.Now()}))
+	assert.Equal(t, 0, q.Spooled())
+	assert.Equal(t, 1, size(t, q))
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, 1, q.Spooled(), "a is spooled once the backend gives up")
+	assert.NoError(t, q.Enqueue(context.Background(), &RetryRequest{ID: "c", RetryAt: fake.Now()}))
+	assert.Equal(t, 2, q.Spooled(), "c is spooled behind a")
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	for _, deadline := range backend.deadlines {
+		assert.WithinDuration(t, before.Add(directTimeout), deadline, time.Second)
+	}
+}
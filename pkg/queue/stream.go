@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// streamGroup is the consumer group every StreamBackend reads with.
+const streamGroup = "retry-workers"
+
+// StreamBackend delivers requests through a Redis stream read by a consumer
+// group, so Redis tracks which consumer holds which request and how often
+// it was delivered (see Pending). Scheduling, payloads, groups and dead
+// letters use the keys of RedisBackend, so the two can be switched without
+// losing requests. A request becomes a stream entry <key>:stream when it is
+// claimed; <key>:entries maps request IDs to their entries. When a lease
+// expires the entry is reclaimed for the next consumer that asks, so
+// requests held by a crashed consumer are delivered again.
+type StreamBackend struct {
+	*RedisBackend
+	consumer string
+}
+
+// NewStreamBackend reads as consumer, which should be unique per process.
+func NewStreamBackend(redisClient *redis.Client, key, consumer string) *StreamBackend {
+	if consumer == "" {
+		panic("stream consumer cannot be empty")
+	}
+	return &StreamBackend{
+		RedisBackend: NewRedisBackend(redisClient, key),
+		consumer:     consumer,
+	}
+}
+
+// newStreamScript adds stream helpers to newScript's. Their last argument
+// is always the consumer group.
+func newStreamScript(src string) *redis.Script {
+	return newScript(`
+local stream = base .. ':stream'
+local entries = base .. ':entries'
+
+-- settle acknowledges and deletes the stream entry of id, if it has one.
+local function settle(id, group)
+	local entry = redis.call('HGET', entries, id)
+	if entry then
+		redis.call('XACK', stream, group, entry)
+		redis.call('XDEL', stream, entry)
+		redis.call('HDEL', entries, id)
+	end
+end
+` + src)
+}
+
+// streamClaimScript first hands out a request whose lease expired, moving
+// its entry to the calling consumer. Otherwise it adds the earliest due
+// request to the stream and reads it back as the calling consumer. As
+// every entry is read right after being added, the stream never holds
+// entries that were not delivered, and the read returns the new entry.
+var streamClaimScript = newStreamScript(`
+local processing = base .. ':processing'
+redis.pcall('XGROUP', 'CREATE', stream, ARGV[4], '$', 'MKSTREAM')
+
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', processing, '-inf', ARGV[2])) do
+	local entry = redis.call('HGET', entries, id)
+	local data = redis.call('GET', dataKey(id))
+	if entry and data then
+		redis.call('XCLAIM', stream, ARGV[4], ARGV[5], 0, entry)
+		redis.call('ZADD', processing, ARGV[3], id)
+		return {id, data}
+	end
+	redis.call('ZREM', processing, id)
+	settle(id, ARGV[4])
+	if data then
+		-- Claimed through RedisBackend, so it has no entry yet.
+		schedule(id, ARGV[1])
+	else
+		finish(id)
+	end
+end
+
+while true do
+	local ids = redis.call('ZRANGEBYSCORE', base, '-inf', ARGV[1], 'LIMIT', 0, 1)
+	if #ids == 0 then
+		return false
+	end
+	local id = ids[1]
+	redis.call('ZREM', base, id)
+	local data = redis.call('GET', dataKey(id))
+	if data then
+		local entry = redis.call('XADD', stream, '*', 'id', id)
+		redis.call('XREADGROUP', 'GROUP', ARGV[4], ARGV[5], 'COUNT', 1, 'STREAMS', stream, '>')
+		redis.call('HSET', entries, id, entry)
+		redis.call('ZADD', processing, ARGV[3], id)
+		return {id, data}
+	end
+	finish(id)
+end
+`)
+
+func (b *StreamBackend) Claim(ctx context.Context, now, leaseExpiry time.Time) (*RetryRequest, error) {
+	leaseUntil := leaseExpiry.UnixMilli()
+	claimed, err := b.run(ctx, streamClaimScript, now.Unix(), now.UnixMilli(), leaseUntil,
+		streamGroup, b.consumer).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var req RetryRequest
+	if err := json.Unmarshal([]byte(claimed[1]), &req); err != nil {
+		// A payload that cannot be decoded would come back forever.
+		b.Ack(ctx, &RetryRequest{ID: claimed[0], leaseUntil: leaseUntil})
+		return nil, err
+	}
+	req.leaseUntil = leaseUntil
+	return &req, nil
+}
+
+var streamAckScript = newStreamScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+settle(ARGV[1], ARGV[3])
+redis.call('DEL', dataKey(ARGV[1]))
+finish(ARGV[1])
+return 1
+`)
+
+func (b *StreamBackend) Ack(ctx context.Context, req *RetryRequest) error {
+	ok, err := b.run(ctx, streamAckScript, req.ID, req.leaseUntil, streamGroup).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+var streamNackScript = newStreamScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+settle(ARGV[1], ARGV[5])
+redis.call('SET', dataKey(ARGV[1]), ARGV[4])
+schedule(ARGV[1], ARGV[3])
+return 1
+`)
+
+func (b *StreamBackend) Nack(ctx context.Context, req *RetryRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := b.run(ctx, streamNackScript, req.ID, req.leaseUntil, req.RetryAt.Unix(), data, streamGroup).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+var streamDeadLetterScript = newStreamScript(`
+if not release(ARGV[1], ARGV[2]) then
+	return 0
+end
+settle(ARGV[1], ARGV[5])
+redis.call('SET', dataKey(ARGV[1]), ARGV[4])
+redis.call('ZADD', base .. ':dead', ARGV[3], ARGV[1])
+return 1
+`)
+
+func (b *StreamBackend) DeadLetter(ctx context.Context, req *RetryRequest, at time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := b.run(ctx, streamDeadLetterScript, req.ID, req.leaseUntil, at.Unix(), data, streamGroup).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// PendingEntry is a request delivered to a consumer and not settled yet.
+type PendingEntry struct {
+	RequestID  string
+	EntryID    string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// Pending lists up to 1000 claimed requests in delivery order with the
+// consumer holding each and how often it was delivered, as tracked by Redis.
+func (b *StreamBackend) Pending(ctx context.Context) ([]PendingEntry, error) {
+	pending, err := b.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: b.key + ":stream",
+		Group:  streamGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  1000,
+	}).Result()
+	if err != nil {
+		if isNoGroup(err) {
+			return []PendingEntry{}, nil
+		}
+		return nil, err
+	}
+	ids, err := b.client.HGetAll(ctx, b.key+":entries").Result()
+	if err != nil {
+		return nil, err
+	}
+	requestIDs := make(map[string]string, len(ids))
+	for id, entry := range ids {
+		requestIDs[entry] = id
+	}
+
+	result := make([]PendingEntry, 0, len(pending))
+	for _, p := range pending {
+		result = append(result, PendingEntry{
+			RequestID:  requestIDs[p.ID],
+			EntryID:    p.ID,
+			Consumer:   p.Consumer,
+			Idle:       p.Idle,
+			Deliveries: p.RetryCount,
+		})
+	}
+	return result, nil
+}
+
+// isNoGroup reports whether err says the stream or its group does not exist
+// yet, i.e. nothing was ever claimed.
+func isNoGroup(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.HasPrefix(redisErr.Error(), "NOGROUP")
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamReclaimsExpiredLeaseForAnotherConsumer(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClock()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	first := NewStreamBackend(client, "", "worker-1")
+	second := NewStreamBackend(client, "", "worker-2")
+	q1 := NewQueueWithBackend(first, WithClock(fake))
+	q2 := NewQueueWithBackend(second, WithClock(fake))
+
+	pending, err := first.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending, "nothing claimed yet")
+
+	q1.Enqueue(ctx, &RetryRequest{ID: "a", RetryAt: fake.Now()})
+	if !assert.NotNil(t, claim(t, q1)) {
+		return
+	}
+	pending, err = first.Pending(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "a", pending[0].RequestID)
+		assert.Equal(t, "worker-1", pending[0].Consumer)
+		assert.Equal(t, int64(1), pending[0].Deliveries)
+	}
+
+	// worker-1 crashes; once its lease expires worker-2 takes the entry over.
+	assert.Nil(t, claim(t, q2))
+	fake.Advance(31 * time.Second)
+	req := claim(t, q2)
+	if !assert.NotNil(t, req) {
+		return
+	}
+	pending, err = second.Pending(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "worker-2", pending[0].Consumer)
+		assert.Equal(t, int64(2), pending[0].Deliveries)
+	}
+
+	assert.NoError(t, q2.Ack(ctx, req))
+	pending, err = second.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	n, err := client.XLen(ctx, "retry_queue:stream").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n, "settled entries are deleted")
+}
+
+func TestStreamClaimDeliversEachRequestOnce(t *testing.T) {
+	const (
+		requests = 100
+		workers  = 8
+	)
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	producer := NewQueueWithBackend(NewStreamBackend(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "", "producer"))
+	for i := 0; i < requests; i++ {
+		producer.Enqueue(ctx, &RetryRequest{ID: fmt.Sprint(i), RetryAt: time.Now().Add(-time.Minute)})
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			consumer := NewQueueWithBackend(NewStreamBackend(client, "", fmt.Sprint("worker-", w)))
+			for {
+				req, err := consumer.Claim(ctx, time.Minute)
+				if err != nil || req == nil {
+					return
+				}
+				mu.Lock()
+				delivered[req.ID]++
+				mu.Unlock()
+				assert.NoError(t, consumer.Ack(ctx, req))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, delivered, requests)
+	for id, n := range delivered {
+		assert.Equal(t, 1, n, "request %s", id)
+	}
+}
@@ -0,0 +1,299 @@
+package retryworker
+
+import (
+	"RSOI_lab_3/pkg/circuitbreaker"
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/queue"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval is how often the worker looks for due requests.
+	Interval = 5 * time.Second
+	// Lease is how long a claimed request is held before another worker
+	// may deliver it.
+	Lease = 30 * time.Second
+	// PauseDelay is how long a request is put back while its endpoint is
+	// paused.
+	PauseDelay = 10 * time.Second
+	// MaxBackoff caps the pause after the queue could not be read.
+	MaxBackoff = 2 * time.Minute
+)
+
+// Worker delivers the requests of a retry queue. Any number of workers, in
+// any number of processes, may consume the same queue: every request is
+// claimed by one of them at a time.
+type Worker struct {
+	queue       *queue.Queue
+	client      *http.Client
+	clock       clock.Clock
+	concurrency int
+	paused      func(req *queue.RetryRequest) bool
+	leader      Leadership
+}
+
+// Leadership elects one of several workers to drain the queue, e.g. a
+// *leader.Elector. Token returns the fencing token of the current term
+// while this process leads; Lock returns the Redis key of the lock and the
+// value it holds during the term of token. An empty key means the term
+// needs no fence.
+type Leadership interface {
+	Token() (int64, bool)
+	Lock(token int64) (key, value string)
+}
+
+// Option customises a Worker at construction time.
+type Option func(*Worker)
+
+// WithClock replaces the wall clock used for ticks, backoff and Retry-After.
+func WithClock(c clock.Clock) Option {
+	return func(w *Worker) {
+		if c != nil {
+			w.clock = c
+		}
+	}
+}
+
+// WithConcurrency sets how many requests are delivered at once; the default
+// is one. Requests of the same group are still delivered in order, as the
+// queue only hands out the head of a group.
+func WithConcurrency(n int) Option {
+	return func(w *Worker) {
+		if n > 0 {
+			w.concurrency = n
+		}
+	}
+}
+
+// WithPause holds back requests for which paused reports true, e.g. because
+// the circuit breaker of their endpoint is open. They are put back for
+// PauseDelay without counting as an attempt.
+func WithPause(paused func(req *queue.RetryRequest) bool) Option {
+	return func(w *Worker) {
+		if paused != nil {
+			w.paused = paused
+		}
+	}
+}
+
+// WithLeadership makes the worker drain the queue only while it leads. Its
+// claims and acknowledgements are fenced by the lock (see queue.WithFence),
+// so a worker that lost the lock, e.g. after a long pause, cannot change
+// the queue any more; what it claimed is delivered again by the next
+// leader once the lease runs out.
+func WithLeadership(l Leadership) Option {
+	return func(w *Worker) {
+		w.leader = l
+	}
+}
+
+func New(q *queue.Queue, client *http.Client, opts ...Option) *Worker {
+	if q == nil {
+		panic("retry worker queue cannot be nil")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	w := &Worker{
+		queue:       q,
+		client:      client,
+		clock:       clock.Real(),
+		concurrency: 1,
+		paused:      func(*queue.RetryRequest) bool { return false },
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run delivers due requests every Interval until ctx is done. While the
+// queue itself is unreachable it backs off, doubling the pause up to
+// MaxBackoff, instead of hammering Redis on every tick.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := w.clock.NewTicker(Interval)
+	defer ticker.Stop()
+	backoff := Interval
+	var resumeAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if w.clock.Now().Before(resumeAt) {
+			continue
+		}
+		if err := w.Drain(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Retry queue unavailable, pausing for %s: %v", backoff, err)
+			resumeAt = w.clock.Now().Add(backoff)
+			backoff = min(2*backoff, MaxBackoff)
+			continue
+		}
+		backoff = Interval
+	}
+}
+
+// Drain delivers requests until none is due, up to the configured number
+// of them at once. It only fails when the queue cannot be read. With
+// leadership it does nothing unless this process leads, and stops once the
+// term ends.
+func (w *Worker) Drain(ctx context.Context) error {
+	var token int64
+	if w.leader != nil {
+		var ok bool
+		if token, ok = w.leader.Token(); !ok {
+			return nil
+		}
+	}
+	if w.leader != nil {
+		if key, value := w.leader.Lock(token); key != "" {
+			ctx = queue.WithFence(ctx, queue.Fence{Key: key, Value: value})
+		}
+	}
+	if w.concurrency == 1 {
+		return w.drain(ctx, token)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.drain(ctx, token); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (w *Worker) drain(ctx context.Context, token int64) error {
+	for {
+		if w.leader != nil {
+			// Saves a claim that the fence would refuse anyway.
+			if current, ok := w.leader.Token(); !ok || current != token {
+				return nil
+			}
+		}
+		req, err := w.queue.Claim(ctx, Lease)
+		if errors.Is(err, queue.ErrFenced) {
+			log.Printf("Stopped draining the retry queue, term %d has ended", token)
+			return nil
+		}
+		if err != nil || req == nil {
+			return err
+		}
+		w.deliver(ctx, req)
+	}
+}
+
+// deliver makes one attempt at a claimed request and settles it: it is
+// acknowledged on success, scheduled again on failure and dead-lettered
+// once its attempts are used up or the upstream rejected it for good.
+func (w *Worker) deliver(ctx context.Context, req *queue.RetryRequest) {
+	if w.paused(req) {
+		req.RetryAt = w.clock.Now().Add(PauseDelay)
+		w.nack(ctx, req)
+		return
+	}
+	log.Printf("Retrying request %s (attempt %d)", req.ID, req.RetryCount+1)
+	status, retryAfter, err := w.execute(ctx, req)
+	if err == nil {
+		w.ack(ctx, req)
+		return
+	}
+	req.RetryCount++
+	req.LastStatus = status
+	req.LastError = err.Error()
+	exhausted := req.MaxRetries > 0 && req.RetryCount >= req.MaxRetries
+	if exhausted || isPermanent(status) || !req.ScheduleRetry(w.clock.Now(), retryAfter) {
+		log.Printf("Retry request %s failed %d times, moving it to dead letters: %v", req.ID, req.RetryCount, err)
+		if err := w.queue.DeadLetter(ctx, req); err != nil {
+			log.Printf("Failed to dead-letter retry request %s: %v", req.ID, err)
+		}
+		return
+	}
+	w.nack(ctx, req)
+}
+
+// ack and nack settle a claimed request. If they fail, the lease runs out
+// and the request is delivered again.
+func (w *Worker) ack(ctx context.Context, req *queue.RetryRequest) {
+	if err := w.queue.Ack(ctx, req); err != nil {
+		log.Printf("Failed to acknowledge retry request %s: %v", req.ID, err)
+	}
+}
+
+func (w *Worker) nack(ctx context.Context, req *queue.RetryRequest) {
+	if err := w.queue.Nack(ctx, req); err != nil {
+		log.Printf("Failed to reschedule retry request %s: %v", req.ID, err)
+	}
+}
+
+// isPermanent reports whether a reply with status rejects the request itself,
+// so that repeating it cannot succeed. 408 and 429 only ask to come back
+// later.
+func isPermanent(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// execute delivers req and returns the upstream status, or zero if no
+// response was received, and the wait requested by a Retry-After header.
+// Anything but a 2xx reply is an error.
+func (w *Worker) execute(ctx context.Context, req *queue.RetryRequest) (int, time.Duration, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, bytes.NewBuffer(req.Body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for k, v := range req.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), w.clock.Now())
+		return resp.StatusCode, retryAfter, &circuitbreaker.HTTPStatusError{StatusCode: resp.StatusCode, Body: body}
+	}
+	return resp.StatusCode, 0, nil
+}
+
+// parseRetryAfter reads a Retry-After value, either seconds or an HTTP
+// date. It returns zero if the header is missing or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package retryworker
+
+import (
+	"RSOI_lab_3/pkg/clock"
+	"RSOI_lab_3/pkg/queue"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueue() (*queue.Queue, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	return queue.NewQueueWithBackend(queue.NewMemoryBackend(), queue.WithClock(fake)), fake
+}
+
+func TestDrainDeliversConcurrently(t *testing.T) {
+	// Every delivery waits until all four are in flight, so the drain only
+	// finishes if they run at the same time.
+	var arrived sync.WaitGroup
+	arrived.Add(4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+	}))
+	defer upstream.Close()
+
+	q, fake := newTestQueue()
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		q.Enqueue(ctx, &queue.RetryRequest{ID: strconv.Itoa(i), Method: "POST", URL: upstream.URL, RetryAt: fake.Now()})
+	}
+
+	done := make(chan error)
+	go func() { done <- New(q, upstream.Client(), WithClock(fake), WithConcurrency(4)).Drain(ctx) }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries did not run concurrently")
+	}
+	size, err := q.Size(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+}
+
+func TestDrainKeepsGroupOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		order = append(order, r.URL.Query().Get("step"))
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	q, fake := newTestQueue()
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		step := strconv.Itoa(i)
+		q.Enqueue(ctx, &queue.RetryRequest{ID: step, Method: "POST", URL: upstream.URL + "?step=" + step, RetryAt: fake.Now(), Group: "reservation"})
+	}
+
+	w := New(q, upstream.Client(), WithClock(fake), WithConcurrency(4))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, w.Drain(ctx))
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, order)
+}
+
+func TestPausedRequestsAreHeldBack(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	q, fake := newTestQueue()
+	ctx := context.Background()
+	q.Enqueue(ctx, &queue.RetryRequest{ID: "a", Method: "POST", URL: upstream.URL, RetryAt: fake.Now(), Breaker: "rating"})
+
+	paused := true
+	w := New(q, upstream.Client(), WithClock(fake), WithPause(func(req *queue.RetryRequest) bool {
+		return paused && req.Breaker == "rating"
+	}))
+	assert.NoError(t, w.Drain(ctx))
+	assert.Equal(t, int32(0), hits.Load())
+	req, err := q.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, req.RetryCount)
+	assert.Equal(t, fake.Now().Add(PauseDelay).Unix(), req.RetryAt.Unix())
+
+	paused = false
+	fake.Advance(PauseDelay)
+	assert.NoError(t, w.Drain(ctx))
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestClientErrorsAreDeadLetteredAtOnce(t *testing.T) {
+	var status atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	q, fake := newTestQueue()
+	ctx := context.Background()
+	w := New(q, upstream.Client(), WithClock(fake))
+	for _, tt := range []struct {
+		status int
+		dead   bool
+	}{
+		{http.StatusNotFound, true},
+		{http.StatusConflict, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		status.Store(int32(tt.status))
+		id := strconv.Itoa(tt.status)
+		q.Enqueue(ctx, &queue.RetryRequest{ID: id, Method: "POST", URL: upstream.URL, RetryAt: fake.Now(), Backoff: queue.BackoffPolicy{Initial: time.Minute}})
+		assert.NoError(t, w.Drain(ctx))
+
+		_, err := q.GetDeadLetter(ctx, id)
+		if tt.dead {
+			assert.NoError(t, err, "status %d", tt.status)
+		} else {
+			assert.ErrorIs(t, err, queue.ErrNotFound, "status %d", tt.status)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-5", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+// fakeLeadership leads with token, fenced by the Redis key "leader".
+type fakeLeadership struct {
+	token int64
+}
+
+func (l *fakeLeadership) Token() (int64, bool) {
+	return l.token, l.token != 0
+}
+
+func (l *fakeLeadership) Lock(token int64) (string, string) {
+	return "leader", "worker-a:" + strconv.FormatInt(token, 10)
+}
+
+func TestDrainOnlyWhileLeading(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Another worker takes the lock while this one still believes
+		// it leads.
+		hits.Add(1)
+		mr.Set("leader", "worker-b:8")
+	}))
+	defer upstream.Close()
+
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	q := queue.NewQueue(client, queue.WithClock(fake))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		q.Enqueue(ctx, &queue.RetryRequest{ID: strconv.Itoa(i), Method: "POST", URL: upstream.URL, RetryAt: fake.Now()})
+	}
+	leadership := &fakeLeadership{}
+	w := New(q, upstream.Client(), WithClock(fake), WithLeadership(leadership))
+
+	assert.NoError(t, w.Drain(ctx))
+	assert.Equal(t, int32(0), hits.Load(), "followers leave the queue alone")
+
+	leadership.token = 7
+	mr.Set("leader", "worker-a:7")
+	assert.NoError(t, w.Drain(ctx))
+	assert.Equal(t, int32(1), hits.Load(), "draining stops once the term has ended")
+	size, _ := q.Size(ctx)
+	assert.Equal(t, 2, size)
+
+	// The acknowledgement was refused, so the next leader delivers the
+	// request again once its lease runs out.
+	fake.Advance(Lease + time.Second)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		req, err := q.Claim(ctx, Lease)
+		assert.NoError(t, err)
+		if assert.NotNil(t, req) {
+			ids = append(ids, req.ID)
+		}
+	}
+	assert.ElementsMatch(t, []string{"0", "1", "2"}, ids)
+}